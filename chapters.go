@@ -0,0 +1,704 @@
+package mp4tag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Nero chpl times are in 100 nanosecond units.
+const chplTimescale = 10000000
+
+// Chapter tracks are written with millisecond timing.
+const chapterTimescale = 1000
+
+func parseChpl(buf []byte) []*MP4Chapter {
+	var chapters []*MP4Chapter
+	if len(buf) < 5 {
+		return nil
+	}
+	idx := 4
+	if buf[0] == 1 {
+		idx += 4
+	}
+	if len(buf) <= idx {
+		return nil
+	}
+	count := int(buf[idx])
+	idx++
+	for i := 0; i < count; i++ {
+		if len(buf) < idx+9 {
+			break
+		}
+		start := binary.BigEndian.Uint64(buf[idx:])
+		titleLen := int(buf[idx+8])
+		idx += 9
+		if len(buf) < idx+titleLen {
+			break
+		}
+		chapter := &MP4Chapter{
+			Start: scaleDuration(start, chplTimescale),
+			Title: string(buf[idx : idx+titleLen]),
+		}
+		chapters = append(chapters, chapter)
+		idx += titleLen
+	}
+	return chapters
+}
+
+func parseChunkOffsetTable(buf []byte, co64 bool) []int64 {
+	var offsets []int64
+	entrySize := 4
+	if co64 {
+		entrySize = 8
+	}
+	for idx := 8; idx+entrySize <= len(buf); idx += entrySize {
+		if co64 {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(buf[idx:])))
+		} else {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(buf[idx:])))
+		}
+	}
+	return offsets
+}
+
+// Counts that don't fit in the box, or samples that couldn't all fit in
+// the file, are treated as a missing table.
+func parseSampleSizes(buf []byte, fileSize int64) []int64 {
+	var sizes []int64
+	if len(buf) < 12 {
+		return nil
+	}
+	sampleSize := int64(binary.BigEndian.Uint32(buf[4:]))
+	count := int64(binary.BigEndian.Uint32(buf[8:]))
+	if sampleSize > 0 && count > fileSize/sampleSize {
+		return nil
+	}
+	if sampleSize == 0 && int64(len(buf)) < 12+count*4 {
+		return nil
+	}
+	for i := int64(0); i < count; i++ {
+		if sampleSize > 0 {
+			sizes = append(sizes, sampleSize)
+			continue
+		}
+		size := int64(binary.BigEndian.Uint32(buf[12+i*4:]))
+		if size > fileSize {
+			return nil
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// Works out where each sample is from stsc, the chunk offsets and stsz.
+func getSampleOffsets(stsc []byte, chunkOffsets, sizes []int64) []int64 {
+	var offsets []int64
+	if len(stsc) < 8 {
+		return nil
+	}
+	entryCount := int(binary.BigEndian.Uint32(stsc[4:]))
+	sample := 0
+	for entry := 0; entry < entryCount; entry++ {
+		idx := 8 + entry*12
+		if len(stsc) < idx+12 {
+			break
+		}
+		firstChunk := int(binary.BigEndian.Uint32(stsc[idx:]))
+		perChunk := int(binary.BigEndian.Uint32(stsc[idx+4:]))
+		lastChunk := len(chunkOffsets)
+		if entry+1 < entryCount && len(stsc) >= idx+16 {
+			lastChunk = int(binary.BigEndian.Uint32(stsc[idx+12:])) - 1
+		}
+		for chunk := firstChunk; chunk <= lastChunk && chunk <= len(chunkOffsets); chunk++ {
+			if chunk < 1 {
+				continue
+			}
+			offset := chunkOffsets[chunk-1]
+			for i := 0; i < perChunk && sample < len(sizes); i++ {
+				offsets = append(offsets, offset)
+				offset += sizes[sample]
+				sample++
+			}
+		}
+	}
+	return offsets
+}
+
+// Stops after maxSamples, as there's nothing to read past the last sample.
+func getSampleStarts(stts []byte, timescale uint32, maxSamples int) []time.Duration {
+	var (
+		starts  []time.Duration
+		elapsed uint64
+	)
+	if len(stts) < 8 {
+		return nil
+	}
+	entryCount := int64(binary.BigEndian.Uint32(stts[4:]))
+	if int64(len(stts)) < 8+entryCount*8 {
+		return nil
+	}
+	for entry := int64(0); entry < entryCount; entry++ {
+		idx := 8 + entry*8
+		count := binary.BigEndian.Uint32(stts[idx:])
+		delta := uint64(binary.BigEndian.Uint32(stts[idx+4:]))
+		for i := uint32(0); i < count; i++ {
+			if len(starts) >= maxSamples {
+				return starts
+			}
+			starts = append(starts, scaleDuration(elapsed, timescale))
+			elapsed += delta
+		}
+	}
+	return starts
+}
+
+// Text samples are a 16-bit length then the text, UTF-16 if it has a BOM.
+func parseTextSample(buf []byte) string {
+	if len(buf) < 2 {
+		return ""
+	}
+	textLen := int(binary.BigEndian.Uint16(buf))
+	text := buf[2:]
+	if textLen < len(text) {
+		text = text[:textLen]
+	}
+	if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+		var units []uint16
+		for idx := 2; idx+1 < len(text); idx += 2 {
+			units = append(units, binary.BigEndian.Uint16(text[idx:]))
+		}
+		return string(utf16.Decode(units))
+	}
+	return string(text)
+}
+
+func (mp4 MP4) readTrackID(boxes MP4Boxes, trak *MP4Box) (int32, error) {
+	tkhd := boxes.getChildBox(trak, "moov.trak.tkhd")
+	if tkhd == nil {
+		return 0, nil
+	}
+	buf, err := mp4.readBoxData(tkhd)
+	if err != nil {
+		return 0, err
+	}
+	return parseTrackID(buf), nil
+}
+
+// Finds the track that tref.chap points at, along with the chap boxes.
+func (mp4 MP4) getChapterTrak(boxes MP4Boxes) (*MP4Box, []*MP4Box, error) {
+	chaps := boxes.getBoxesByPath("moov.trak.tref.chap")
+	if chaps == nil {
+		return nil, nil, nil
+	}
+	buf, err := mp4.readBoxData(chaps[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buf) < 4 {
+		return nil, chaps, nil
+	}
+	chapID := int32(binary.BigEndian.Uint32(buf))
+	for _, trak := range boxes.getBoxesByPath("moov.trak") {
+		id, err := mp4.readTrackID(boxes, trak)
+		if err != nil {
+			return nil, nil, err
+		}
+		if id == chapID {
+			return trak, chaps, nil
+		}
+	}
+	return nil, chaps, nil
+}
+
+// Reads where each of a track's samples is, how big it is and when it starts.
+func (mp4 MP4) readSampleTables(boxes MP4Boxes, trak *MP4Box) ([]int64, []int64, []time.Duration, error) {
+	co64 := false
+	chunkBox := boxes.getChildBox(trak, "moov.trak.mdia.minf.stbl.stco")
+	if chunkBox == nil {
+		chunkBox = boxes.getChildBox(trak, "moov.trak.mdia.minf.stbl.co64")
+		co64 = true
+	}
+	paths := []string{
+		"moov.trak.mdia.mdhd",
+		"moov.trak.mdia.minf.stbl.stts",
+		"moov.trak.mdia.minf.stbl.stsc",
+		"moov.trak.mdia.minf.stbl.stsz",
+	}
+	var bufs [][]byte
+	for _, path := range paths {
+		box := boxes.getChildBox(trak, path)
+		if box == nil || chunkBox == nil {
+			return nil, nil, nil, nil
+		}
+		buf, err := mp4.readBoxData(box)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bufs = append(bufs, buf)
+	}
+	chunkBuf, err := mp4.readBoxData(chunkBox)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, timescale := parseTimeHeader(bufs[0])
+	sizes := parseSampleSizes(bufs[3], mp4.size)
+	starts := getSampleStarts(bufs[1], timescale, len(sizes))
+	offsets := getSampleOffsets(bufs[2], parseChunkOffsetTable(chunkBuf, co64), sizes)
+	return offsets, sizes, starts, nil
+}
+
+func (mp4 MP4) readChapterTrak(boxes MP4Boxes, trak *MP4Box) ([]*MP4Chapter, error) {
+	var chapters []*MP4Chapter
+	offsets, sizes, starts, err := mp4.readSampleTables(boxes, trak)
+	if err != nil {
+		return nil, err
+	}
+	for idx, offset := range offsets {
+		if idx >= len(starts) {
+			break
+		}
+		if offset < 0 || offset+sizes[idx] > mp4.size {
+			break
+		}
+		// Text past the 16-bit length is never used.
+		size := sizes[idx]
+		if size > 2+math.MaxUint16 {
+			size = 2 + math.MaxUint16
+		}
+		buf := make([]byte, size)
+		_, err = mp4.r.Seek(offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(mp4.r, buf)
+		if err != nil {
+			return nil, err
+		}
+		chapter := &MP4Chapter{
+			Start: starts[idx],
+			Title: parseTextSample(buf),
+		}
+		chapters = append(chapters, chapter)
+	}
+	return chapters, nil
+}
+
+// Finds the mdat holding the chapter samples, if it holds nothing else.
+func (mp4 MP4) getChapterMdat(boxes MP4Boxes, trak *MP4Box) (*MP4Box, error) {
+	offsets, sizes, _, err := mp4.readSampleTables(boxes, trak)
+	if err != nil || offsets == nil {
+		return nil, err
+	}
+	start, end := offsets[0], offsets[0]
+	for idx, offset := range offsets {
+		if offset < start {
+			start = offset
+		}
+		if offset+sizes[idx] > end {
+			end = offset + sizes[idx]
+		}
+	}
+	for _, mdat := range boxes.getBoxesByPath("mdat") {
+		if mdat.StartOffset+mdat.HeaderSize == start && mdat.EndOffset == end {
+			return mdat, nil
+		}
+	}
+	return nil, nil
+}
+
+// Prefers the QuickTime chapter track, falling back to Nero chapters.
+func (mp4 MP4) readChapters(boxes MP4Boxes) ([]*MP4Chapter, error) {
+	trak, _, err := mp4.getChapterTrak(boxes)
+	if err != nil {
+		return nil, err
+	}
+	if trak != nil {
+		chapters, err := mp4.readChapterTrak(boxes, trak)
+		if err != nil || chapters != nil {
+			return chapters, err
+		}
+	}
+	chpl := boxes.getBoxByPath("moov.udta.chpl")
+	if chpl == nil {
+		return nil, nil
+	}
+	buf, err := mp4.readBoxData(chpl)
+	if err != nil {
+		return nil, err
+	}
+	return parseChpl(buf), nil
+}
+
+func sortChapters(chapters []*MP4Chapter) []*MP4Chapter {
+	var sorted []*MP4Chapter
+	for _, chapter := range chapters {
+		if chapter != nil {
+			sorted = append(sorted, chapter)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	return sorted
+}
+
+// Cuts a string down to max bytes without splitting a rune.
+func truncateString(str string, max int) string {
+	if len(str) <= max {
+		return str
+	}
+	for max > 0 && !utf8.RuneStart(str[max]) {
+		max--
+	}
+	return str[:max]
+}
+
+// Version 1 chpl, as written by Nero and ffmpeg. Holds up to 255 chapters.
+func makeChpl(chapters []*MP4Chapter) []byte {
+	chapters = sortChapters(chapters)
+	if len(chapters) > 255 {
+		chapters = chapters[:255]
+	}
+	payload := []byte{0x01, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
+	payload = append(payload, byte(len(chapters)))
+	for _, chapter := range chapters {
+		title := truncateString(chapter.Title, 255)
+		payload = append(payload, putI64BE(int64(chapter.Start/100))...)
+		payload = append(payload, byte(len(title)))
+		payload = append(payload, title...)
+	}
+	return makeBox("chpl", payload)
+}
+
+func makeFullBox(boxName string, version byte, flags uint32, payload []byte) []byte {
+	full := putI32BE(int32(uint32(version)<<24 | flags))
+	return makeBox(boxName, append(full, payload...))
+}
+
+func toTimescale(d time.Duration, timescale uint32) uint32 {
+	if d < 0 {
+		return 0
+	}
+	scaled := uint64(d) * uint64(timescale) / uint64(time.Second)
+	if scaled > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(scaled)
+}
+
+// Makes a disabled QuickTime text track for the chapters and its samples.
+// The single chunk offset is left as 0 for the caller to fill in at the
+// returned index.
+func makeChapterTrak(id int32, chapters []*MP4Chapter, duration time.Duration, movieTimescale uint32, co64 bool) ([]byte, []byte, int) {
+	var (
+		samples []byte
+		stts    []byte
+		stsz    []byte
+	)
+	encd := []byte{0x0, 0x0, 0x0, 0x0C, 'e', 'n', 'c', 'd', 0x0, 0x0, 0x01, 0x0}
+	for idx, chapter := range chapters {
+		title := truncateString(chapter.Title, math.MaxUint16)
+		sample := putI16BE(int16(uint16(len(title))))
+		sample = append(sample, title...)
+		sample = append(sample, encd...)
+		samples = append(samples, sample...)
+		stsz = append(stsz, putI32BE(int32(len(sample)))...)
+
+		end := duration
+		if idx+1 < len(chapters) {
+			end = chapters[idx+1].Start
+		}
+		delta := toTimescale(end, chapterTimescale) - toTimescale(chapter.Start, chapterTimescale)
+		if end <= chapter.Start || delta == 0 {
+			delta = 1
+		}
+		stts = append(stts, putI32BE(1)...)
+		stts = append(stts, putI32BE(int32(delta))...)
+	}
+	count := putI32BE(int32(len(chapters)))
+
+	tkhd := make([]byte, 80)
+	copy(tkhd[8:], putI32BE(id))
+	copy(tkhd[16:], putI32BE(int32(toTimescale(duration, movieTimescale))))
+	// Identity matrix.
+	copy(tkhd[36:], putI32BE(0x00010000))
+	copy(tkhd[52:], putI32BE(0x00010000))
+	copy(tkhd[68:], putI32BE(0x40000000))
+
+	mdhd := make([]byte, 20)
+	copy(mdhd[8:], putI32BE(chapterTimescale))
+	copy(mdhd[12:], putI32BE(int32(toTimescale(duration, chapterTimescale))))
+	// Undetermined language.
+	copy(mdhd[16:], []byte{0x55, 0xC4})
+
+	hdlr := make([]byte, 4)
+	hdlr = append(hdlr, "text"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+
+	gmin := []byte{0x0, 0x40, 0x80, 0x0, 0x80, 0x0, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0}
+	text := []byte{0x0, 0x01}
+	text = append(text, make([]byte, 12)...)
+	text = append(text, putI32BE(1)...)
+	text = append(text, make([]byte, 12)...)
+	text = append(text, putI32BE(0x4000)...)
+	text = append(text, 0x0, 0x0)
+	gmhd := makeBox("gmhd", append(makeFullBox("gmin", 0, 0, gmin), makeBox("text", text)...))
+
+	url := makeFullBox("url ", 0, 1, nil)
+	dinf := makeBox("dinf", makeFullBox("dref", 0, 0, append(putI32BE(1), url...)))
+
+	// QuickTime text sample description, all defaults.
+	entry := []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x01}
+	entry = append(entry, make([]byte, 44)...)
+	stsd := makeFullBox("stsd", 0, 0, append(putI32BE(1), makeBox("text", entry)...))
+
+	stsc := append(putI32BE(1), putI32BE(1)...)
+	stsc = append(stsc, count...)
+	stsc = append(stsc, putI32BE(1)...)
+
+	stszPayload := append(putI32BE(0), count...)
+	stszPayload = append(stszPayload, stsz...)
+
+	var chunkOffsets []byte
+	if co64 {
+		chunkOffsets = makeFullBox("co64", 0, 0, append(putI32BE(1), make([]byte, 8)...))
+	} else {
+		chunkOffsets = makeFullBox("stco", 0, 0, append(putI32BE(1), make([]byte, 4)...))
+	}
+
+	stbl := bytes.Join([][]byte{
+		stsd,
+		makeFullBox("stts", 0, 0, append(count, stts...)),
+		makeFullBox("stsc", 0, 0, stsc),
+		makeFullBox("stsz", 0, 0, stszPayload),
+		chunkOffsets,
+	}, nil)
+	minf := append(gmhd, dinf...)
+	minf = append(minf, makeBox("stbl", stbl)...)
+	mdia := bytes.Join([][]byte{
+		makeFullBox("mdhd", 0, 0, mdhd),
+		makeFullBox("hdlr", 0, 0, hdlr),
+		makeBox("minf", minf),
+	}, nil)
+	trak := append(makeFullBox("tkhd", 0, 0, tkhd), makeBox("mdia", mdia)...)
+	trak = makeBox("trak", trak)
+	// The chunk offset is the last thing in the track.
+	offsetAt := len(trak) - 4
+	if co64 {
+		offsetAt = len(trak) - 8
+	}
+	return trak, samples, offsetAt
+}
+
+// Removes the tref.chap boxes, and their tref if they're its only child.
+func removeChapterRefs(boxes MP4Boxes, chaps []*MP4Box) []*patch {
+	var changes []*patch
+	for _, chap := range chaps {
+		ancestors := boxes.getAncestors(chap)
+		var tref, trak *MP4Box
+		for _, box := range ancestors {
+			switch box.Path {
+			case "moov.trak.tref":
+				tref = box
+			case "moov.trak":
+				trak = box
+			}
+		}
+		if tref == nil || trak == nil {
+			continue
+		}
+		if tref.BoxSize-tref.HeaderSize == chap.BoxSize {
+			changes = append(changes, &patch{
+				start:  tref.StartOffset,
+				end:    tref.EndOffset,
+				parent: trak,
+			})
+			continue
+		}
+		changes = append(changes, &patch{
+			start:  chap.StartOffset,
+			end:    chap.EndOffset,
+			parent: tref,
+		})
+	}
+	return changes
+}
+
+// Points every audio and video track at the chapter track.
+func (mp4 MP4) addChapterRefs(boxes MP4Boxes, id int32) ([]*patch, error) {
+	var changes []*patch
+	chap := makeBox("chap", putI32BE(id))
+	for _, trak := range boxes.getBoxesByPath("moov.trak") {
+		hdlr := boxes.getChildBox(trak, "moov.trak.mdia.hdlr")
+		if hdlr == nil {
+			continue
+		}
+		buf, err := mp4.readBoxData(hdlr)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < 12 || (string(buf[8:12]) != "soun" && string(buf[8:12]) != "vide") {
+			continue
+		}
+		tref := boxes.getChildBox(trak, "moov.trak.tref")
+		if tref == nil {
+			changes = append(changes, &patch{
+				start:  trak.EndOffset,
+				end:    trak.EndOffset,
+				data:   makeBox("tref", chap),
+				parent: trak,
+			})
+			continue
+		}
+		changes = append(changes, &patch{
+			start:  tref.EndOffset,
+			end:    tref.EndOffset,
+			data:   chap,
+			parent: tref,
+		})
+	}
+	return changes, nil
+}
+
+// Adds the changes that write chapters in both forms, or remove them if
+// there are none, to the ones already planned.
+func (mp4 MP4) planChapters(boxes MP4Boxes, chapters []*MP4Chapter, changes []*patch) ([]*patch, error) {
+	chapters = sortChapters(chapters)
+	moov := boxes.getBoxByPath("moov")
+	udta := boxes.getBoxByPath("moov.udta")
+	chpl := boxes.getBoxByPath("moov.udta.chpl")
+	var chplData []byte
+	if len(chapters) > 0 {
+		chplData = makeChpl(chapters)
+	}
+	if chpl != nil {
+		changes = append(changes, &patch{
+			start:  chpl.StartOffset,
+			end:    chpl.EndOffset,
+			data:   chplData,
+			parent: udta,
+		})
+	} else if udta != nil && chplData != nil {
+		changes = append(changes, &patch{
+			start:  udta.childrenEnd(),
+			end:    udta.childrenEnd(),
+			data:   chplData,
+			parent: udta,
+		})
+	}
+
+	trak, chaps, err := mp4.getChapterTrak(boxes)
+	if err != nil {
+		return nil, err
+	}
+	var mdat *MP4Box
+	if trak != nil {
+		mdat, err = mp4.getChapterMdat(boxes, trak)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(chapters) == 0 {
+		if trak != nil {
+			changes = append(changes, &patch{
+				start:  trak.StartOffset,
+				end:    trak.EndOffset,
+				parent: moov,
+			})
+		}
+		if mdat != nil {
+			changes = append(changes, &patch{
+				start: mdat.StartOffset,
+				end:   mdat.EndOffset,
+			})
+		}
+		return append(changes, removeChapterRefs(boxes, chaps)...), nil
+	}
+
+	mvhd := boxes.getBoxByPath("moov.mvhd")
+	if mvhd == nil {
+		return nil, &ErrBoxNotPresent{Msg: "moov.mvhd box not present"}
+	}
+	mvhdBuf, err := mp4.readBoxData(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	duration, movieTimescale := parseTimeHeader(mvhdBuf)
+	if last := chapters[len(chapters)-1].Start; duration <= last {
+		duration = last + time.Second
+	}
+	if len(mvhdBuf) < 4 {
+		return nil, &ErrBoxNotPresent{Msg: "moov.mvhd box is truncated"}
+	}
+	nextID := int32(binary.BigEndian.Uint32(mvhdBuf[len(mvhdBuf)-4:]))
+
+	var trakChange *patch
+	if trak != nil {
+		id, err := mp4.readTrackID(boxes, trak)
+		if err != nil {
+			return nil, err
+		}
+		trakChange = &patch{
+			start:  trak.StartOffset,
+			end:    trak.EndOffset,
+			parent: moov,
+		}
+		nextID = id
+	} else {
+		traks := boxes.getBoxesByPath("moov.trak")
+		insertAt := moov.childrenEnd()
+		if traks != nil {
+			insertAt = traks[len(traks)-1].EndOffset
+		}
+		trakChange = &patch{
+			start:  insertAt,
+			end:    insertAt,
+			parent: moov,
+		}
+		changes = append(changes, &patch{
+			start: mvhd.EndOffset - 4,
+			end:   mvhd.EndOffset,
+			data:  putI32BE(nextID + 1),
+		})
+		// Any dangling references are replaced.
+		changes = append(changes, removeChapterRefs(boxes, chaps)...)
+		refChanges, err := mp4.addChapterRefs(boxes, nextID)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, refChanges...)
+	}
+
+	// The samples go in their own mdat, replacing the old one if there is
+	// one, otherwise straight after moov.
+	mdatChange := &patch{
+		start: moov.EndOffset,
+		end:   moov.EndOffset,
+	}
+	if mdat != nil {
+		mdatChange.start = mdat.StartOffset
+		mdatChange.end = mdat.EndOffset
+	}
+	trakData, samples, offsetAt := makeChapterTrak(nextID, chapters, duration, movieTimescale, false)
+	trakChange.data = trakData
+	changes = append(changes, trakChange)
+	samplesAt := shiftOffset(changes, mdatChange.start) + 8
+	if samplesAt+int64(len(samples)) > math.MaxUint32 {
+		trakData, samples, offsetAt = makeChapterTrak(nextID, chapters, duration, movieTimescale, true)
+		trakChange.data = trakData
+		samplesAt = shiftOffset(changes, mdatChange.start) + 8
+		copy(trakData[offsetAt:], putI64BE(samplesAt))
+	} else {
+		copy(trakData[offsetAt:], putI32BE(int32(samplesAt)))
+	}
+	mdatChange.data = makeBox("mdat", samples)
+	changes = append(changes, mdatChange)
+	return changes, nil
+}
@@ -0,0 +1,121 @@
+package mp4tag
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseSampleSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		buf      []byte
+		fileSize int64
+		want     int
+	}{
+		{"fixed", bytes.Join([][]byte{make([]byte, 4), putI32BE(10), putI32BE(3)}, nil), 100, 3},
+		{"fixed past the file", bytes.Join([][]byte{make([]byte, 4), putI32BE(1), putI32BE(math.MaxInt32)}, nil), 100, 0},
+		{"table", bytes.Join([][]byte{make([]byte, 8), putI32BE(2), putI32BE(5), putI32BE(6)}, nil), 100, 2},
+		{"count past the box", bytes.Join([][]byte{make([]byte, 8), putI32BE(math.MaxInt32), putI32BE(5)}, nil), 100, 0},
+		{"size past the file", bytes.Join([][]byte{make([]byte, 8), putI32BE(1), putI32BE(math.MaxInt32)}, nil), 100, 0},
+		{"short", make([]byte, 8), 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := parseSampleSizes(tt.buf, tt.fileSize)
+			if len(sizes) != tt.want {
+				t.Errorf("got %d sizes, want %d", len(sizes), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSampleStarts(t *testing.T) {
+	tests := []struct {
+		name       string
+		buf        []byte
+		maxSamples int
+		want       int
+	}{
+		{"entries", bytes.Join([][]byte{make([]byte, 4), putI32BE(2), putI32BE(2), putI32BE(10), putI32BE(1), putI32BE(5)}, nil), 10, 3},
+		{"huge sample count", bytes.Join([][]byte{make([]byte, 4), putI32BE(1), putI32BE(-1), putI32BE(10)}, nil), 4, 4},
+		{"count past the box", bytes.Join([][]byte{make([]byte, 4), putI32BE(math.MaxInt32), putI32BE(1), putI32BE(10)}, nil), 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			starts := getSampleStarts(tt.buf, 1000, tt.maxSamples)
+			if len(starts) != tt.want {
+				t.Errorf("got %d starts, want %d", len(starts), tt.want)
+			}
+		})
+	}
+}
+
+func TestChapterWrite(t *testing.T) {
+	first := []*MP4Chapter{{Start: 0, Title: "Intro"}, {Start: 90 * time.Second, Title: "Chapter 1"}}
+	second := []*MP4Chapter{{Start: 0, Title: "One"}, {Start: time.Second, Title: "Two"}, {Start: 2 * time.Second, Title: "Three"}}
+	tests := []struct {
+		name string
+		opts testFileOpts
+	}{
+		{"moov first", testFileOpts{}},
+		{"mdat first", testFileOpts{mdatFirst: true}},
+		{"co64", testFileOpts{co64: true}},
+		{"no udta", testFileOpts{noUdta: true}},
+		{"size 0 mdat", testFileOpts{zeroMdat: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			steps := []struct {
+				chapters   []*MP4Chapter
+				delStrings []string
+			}{
+				{first, nil},
+				{second, nil},
+				{nil, []string{"chapters"}},
+			}
+			for _, step := range steps {
+				err = mp4.Write(&MP4Tags{Chapters: step.chapters}, step.delStrings)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nodes := checkTestFile(t, path)
+				traks := 0
+				for _, node := range nodes {
+					if node.path == "moov.trak" {
+						traks++
+					}
+				}
+				wantTraks := 1
+				if step.chapters != nil {
+					wantTraks = 2
+				}
+				if traks != wantTraks {
+					t.Errorf("%d traks, want %d", traks, wantTraks)
+				}
+				if hasTestNode(nodes, "moov.udta.chpl") != (step.chapters != nil) {
+					t.Error("chpl is wrong")
+				}
+				tags, err := mp4.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tags.Chapters) != len(step.chapters) {
+					t.Fatalf("read %d chapters, want %d", len(tags.Chapters), len(step.chapters))
+				}
+				for idx, chapter := range tags.Chapters {
+					if *chapter != *step.chapters[idx] {
+						t.Errorf("chapter %d is %v, want %v", idx, chapter, step.chapters[idx])
+					}
+				}
+			}
+		})
+	}
+}
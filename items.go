@@ -0,0 +1,342 @@
+package mp4tag
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// The mean of freeform atoms read into Custom. Freeform atoms with any
+// other mean are kept as items.
+const itunesMean = "com.apple.iTunes"
+
+// Looks up the deletion strings for a known atom, ignoring case.
+func getKnownItem(name string) ([]string, bool) {
+	if strings.HasPrefix(name, "----") {
+		name = "----"
+	}
+	for known, delStrings := range knownItems {
+		if strings.EqualFold(known, name) {
+			return delStrings, true
+		}
+	}
+	return nil, false
+}
+
+// Turns item deletion strings for atoms with their own fields into the
+// field deletion strings. Freeform items delete their custom tag.
+func expandItemDelStrings(delStrings []string) []string {
+	expanded := append([]string{}, delStrings...)
+	for _, delString := range delStrings {
+		name := strings.TrimPrefix(delString, "item:")
+		if name == delString {
+			continue
+		}
+		split := strings.SplitN(name, ":", 3)
+		if len(split) == 3 && split[0] == "----" {
+			if strings.EqualFold(split[1], itunesMean) {
+				expanded = append(expanded, "custom:"+split[2])
+			}
+			continue
+		}
+		fieldDelStrings, ok := getKnownItem(name)
+		if ok {
+			expanded = append(expanded, fieldDelStrings...)
+		}
+	}
+	return expanded
+}
+
+func hasItem(items []*MP4Item, name string) bool {
+	for _, item := range items {
+		if item != nil && item.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a full box holding a string, like mean and name in freeform atoms.
+func parseFullBoxString(buf []byte, boxName string) (string, int) {
+	if len(buf) < 12 || string(buf[4:8]) != boxName {
+		return "", 0
+	}
+	size := int(binary.BigEndian.Uint32(buf))
+	if size < 12 || size > len(buf) {
+		return "", 0
+	}
+	return string(buf[12:size]), size
+}
+
+func parseDataBoxes(name string, buf []byte) []*MP4Item {
+	var items []*MP4Item
+	for idx := 0; idx+16 <= len(buf); {
+		size := int(binary.BigEndian.Uint32(buf[idx:]))
+		if size < 16 || idx+size > len(buf) {
+			break
+		}
+		if string(buf[idx+4:idx+8]) == "data" {
+			item := &MP4Item{
+				Name:   name,
+				Type:   DataType(binary.BigEndian.Uint32(buf[idx+8:])),
+				Locale: binary.BigEndian.Uint32(buf[idx+12:]),
+				Data:   buf[idx+16 : idx+size],
+			}
+			items = append(items, item)
+		}
+		idx += size
+	}
+	return items
+}
+
+// Reads a box's name as it is in the file, with (c) in place of ©.
+func (mp4 MP4) readAtomName(box *MP4Box) (string, error) {
+	_, err := mp4.r.Seek(box.StartOffset+4, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	name, err := mp4.readString(4)
+	if err != nil {
+		return "", err
+	}
+	if name[0] == 0xA9 {
+		name = "(c)" + name[1:]
+	}
+	return name, nil
+}
+
+// Turns an atom name with (c) for © back into its four bytes.
+func getAtomName(name string) ([]byte, error) {
+	boxName := []byte(name)
+	if strings.HasPrefix(name, "(c)") {
+		boxName = append([]byte{0xA9}, name[3:]...)
+	}
+	if len(boxName) != 4 {
+		return nil, &ErrInvalidItemName{Name: name}
+	}
+	return boxName, nil
+}
+
+// Reads every data box in ilst, or only those of atoms without a field of
+// their own. Names are read again from the file as readBoxName lowercases
+// them.
+func (mp4 MP4) readItems(boxes MP4Boxes, all bool) ([]*MP4Item, error) {
+	var items []*MP4Item
+	for _, box := range boxes.Boxes {
+		name := strings.TrimPrefix(box.Path, "moov.udta.meta.ilst.")
+		if name == box.Path || strings.Contains(name, ".") {
+			continue
+		}
+		_, known := knownItems[name]
+		if known && !all && name != "----" && name != "rtng" && name != "stik" {
+			continue
+		}
+		name, err := mp4.readAtomName(box)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := mp4.readBoxData(box)
+		if err != nil {
+			return nil, err
+		}
+		if name == "----" {
+			mean, meanSize := parseFullBoxString(buf, "mean")
+			if mean == itunesMean && !all {
+				continue
+			}
+			freeformName, nameSize := parseFullBoxString(buf[meanSize:], "name")
+			name = "----:" + mean + ":" + freeformName
+			buf = buf[meanSize+nameSize:]
+		}
+		for _, item := range parseDataBoxes(name, buf) {
+			if all || (name != "rtng" && name != "stik") || isUnknownCode(item) {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// Reports whether a rtng or stik item holds a code without a constant.
+// These read as none, so they're kept as items to be written back as is.
+func isUnknownCode(item *MP4Item) bool {
+	if len(item.Data) < 1 {
+		return false
+	}
+	var ok bool
+	switch item.Name {
+	case "rtng":
+		_, ok = resolveItunesAdvisory[item.Data[0]]
+	case "stik":
+		_, ok = resolveItunesStik[item.Data[len(item.Data)-1]]
+	default:
+		return false
+	}
+	return !ok
+}
+
+func makeFullBoxString(boxName, value string) []byte {
+	return makeBox(boxName, append(make([]byte, 4), value...))
+}
+
+// Writes items out, one atom per name holding all of its data boxes.
+func writeItems(w io.Writer, items []*MP4Item) error {
+	var names []string
+	atoms := map[string][]byte{}
+	for _, item := range items {
+		_, ok := atoms[item.Name]
+		if !ok {
+			names = append(names, item.Name)
+		}
+		data := putI32BE(int32(len(item.Data) + 16))
+		data = append(data, "data"...)
+		data = append(data, putI32BE(int32(item.Type))...)
+		data = append(data, putI32BE(int32(item.Locale))...)
+		data = append(data, item.Data...)
+		atoms[item.Name] = append(atoms[item.Name], data...)
+	}
+	for _, name := range names {
+		atomName := name
+		payload := atoms[name]
+		split := strings.SplitN(name, ":", 3)
+		if len(split) == 3 && split[0] == "----" {
+			atomName = split[0]
+			freeform := makeFullBoxString("mean", split[1])
+			freeform = append(freeform, makeFullBoxString("name", split[2])...)
+			payload = append(freeform, payload...)
+		}
+		boxName, err := getAtomName(atomName)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(putI32BE(int32(len(payload) + 8)))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(boxName)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getItemPicType(pic *MP4Picture) DataType {
+	magic := make([]byte, 4)
+	copy(magic, pic.Data)
+	return DataType(getPicFormat(pic.Format, magic))
+}
+
+// Makes an item from a Go value, picking the data type from the value's type.
+func newItem(name string, value interface{}) (*MP4Item, error) {
+	item := &MP4Item{Name: name}
+	switch v := value.(type) {
+	case string:
+		item.Type, item.Data = DataTypeUTF8, []byte(v)
+	case []byte:
+		item.Type, item.Data = DataTypeBinary, v
+	case bool:
+		item.Type, item.Data = DataTypeSignedInt, []byte{0x0}
+		if v {
+			item.Data[0] = 0x01
+		}
+	case int8:
+		item.Type, item.Data = DataTypeSignedInt, []byte{byte(v)}
+	case int16:
+		item.Type, item.Data = DataTypeSignedInt, putI16BE(v)
+	case int32:
+		item.Type, item.Data = DataTypeSignedInt, putI32BE(v)
+	case int64:
+		item.Type, item.Data = DataTypeSignedInt, putI64BE(v)
+	case int:
+		item.Type, item.Data = DataTypeSignedInt, putI64BE(int64(v))
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			item.Data = putI32BE(int32(v))
+		}
+	case uint8:
+		item.Type, item.Data = DataTypeUnsignedInt, []byte{v}
+	case uint16:
+		item.Type, item.Data = DataTypeUnsignedInt, putI16BE(int16(v))
+	case uint32:
+		item.Type, item.Data = DataTypeUnsignedInt, putI32BE(int32(v))
+	case uint64:
+		item.Type, item.Data = DataTypeUnsignedInt, putI64BE(int64(v))
+	case uint:
+		item.Type, item.Data = DataTypeUnsignedInt, putI64BE(int64(v))
+		if v <= math.MaxUint32 {
+			item.Data = putI32BE(int32(uint32(v)))
+		}
+	case float32:
+		item.Type, item.Data = DataTypeFloat32, putI32BE(int32(math.Float32bits(v)))
+	case float64:
+		item.Type, item.Data = DataTypeFloat64, putI64BE(int64(math.Float64bits(v)))
+	case *MP4Picture:
+		item.Type, item.Data = getItemPicType(v), v.Data
+	case *MP4Item:
+		item.Type, item.Locale, item.Data = v.Type, v.Locale, v.Data
+	default:
+		return nil, &ErrUnsupportedItemValue{Value: value}
+	}
+	return item, nil
+}
+
+// String decodes UTF-8 and UTF-16 items. Other types give "".
+func (item *MP4Item) String() string {
+	switch item.Type {
+	case DataTypeUTF8:
+		return string(item.Data)
+	case DataTypeUTF16:
+		var units []uint16
+		for idx := 0; idx+1 < len(item.Data); idx += 2 {
+			units = append(units, binary.BigEndian.Uint16(item.Data[idx:]))
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
+
+// Int decodes big endian integer items of any width. Other types give 0.
+func (item *MP4Item) Int() int64 {
+	var signed bool
+	switch item.Type {
+	case DataTypeSignedInt, DataTypeInt8, DataTypeInt16, DataTypeInt32, DataTypeInt64:
+		signed = true
+	case DataTypeUnsignedInt, DataTypeUint8, DataTypeUint16, DataTypeUint32, DataTypeUint64:
+	default:
+		return 0
+	}
+	return getIntBE(item.Data, signed)
+}
+
+// Decodes a big endian int of 1 to 8 bytes.
+func getIntBE(buf []byte, signed bool) int64 {
+	if len(buf) == 0 || len(buf) > 8 {
+		return 0
+	}
+	var num uint64
+	for _, b := range buf {
+		num = num<<8 | uint64(b)
+	}
+	if signed && buf[0]&0x80 != 0 {
+		shift := uint(64 - len(buf)*8)
+		return int64(num<<shift) >> shift
+	}
+	return int64(num)
+}
+
+// Float decodes float32 and float64 items. Other types give 0.
+func (item *MP4Item) Float() float64 {
+	switch {
+	case item.Type == DataTypeFloat32 && len(item.Data) == 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(item.Data)))
+	case item.Type == DataTypeFloat64 && len(item.Data) == 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(item.Data))
+	}
+	return 0
+}
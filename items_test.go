@@ -0,0 +1,228 @@
+package mp4tag
+
+import (
+	"bytes"
+	"testing"
+)
+
+func findItem(items []*MP4Item, name string) *MP4Item {
+	for _, item := range items {
+		if item.Name == name {
+			return item
+		}
+	}
+	return nil
+}
+
+func TestUnknownItemKept(t *testing.T) {
+	unknown := testItem("xyzw", DataTypeBinary, []byte{1, 2, 3})
+	path := writeTestFile(t, makeTestFile(testFileOpts{items: [][]byte{unknown}}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	err = mp4.Write(&MP4Tags{Title: "title"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := findItem(items, "xyzw")
+	if item == nil || item.Type != DataTypeBinary || !bytes.Equal(item.Data, []byte{1, 2, 3}) {
+		t.Errorf("unknown item is %v", item)
+	}
+}
+
+func testFreeform(mean, name, value string) []byte {
+	data := testBox("data", putI32BE(int32(DataTypeUTF8)), make([]byte, 4), []byte(value))
+	return testBox("----", testFullBox("mean", 0, 0, []byte(mean)), testFullBox("name", 0, 0, []byte(name)), data)
+}
+
+func TestVendorFreeformKept(t *testing.T) {
+	items := [][]byte{
+		testFreeform("org.example", "myTag", "vendor"),
+		testFreeform("com.apple.iTunes", "MOOD", "calm"),
+	}
+	path := writeTestFile(t, makeTestFile(testFileOpts{items: items}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	err = mp4.Write(&MP4Tags{Title: "title"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	tags, err := mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags.Custom) != 1 || tags.Custom["MOOD"] != "calm" {
+		t.Errorf("custom is %v", tags.Custom)
+	}
+	item := findItem(tags.RawItems, "----:org.example:myTag")
+	if item == nil || item.String() != "vendor" {
+		t.Errorf("raw items are %v", tags.RawItems)
+	}
+	if findItem(tags.RawItems, "----:com.apple.iTunes:MOOD") != nil {
+		t.Error("iTunes freeform atom is in raw items")
+	}
+}
+
+func TestUnknownCodesKept(t *testing.T) {
+	items := [][]byte{
+		testItem("rtng", DataTypeSignedInt, []byte{4}),
+		testItem("stik", DataTypeSignedInt, []byte{99}),
+	}
+	tests := []struct {
+		name       string
+		tags       *MP4Tags
+		delStrings []string
+		rtng       []byte
+		stik       []byte
+	}{
+		{"keep", &MP4Tags{Title: "title"}, nil, []byte{4}, []byte{99}},
+		{"replace", &MP4Tags{ItunesAdvisory: ItunesAdvisoryExplicit, ItunesStik: Movie}, nil, []byte{1}, []byte{byte(Movie)}},
+		{"delete", &MP4Tags{Title: "title"}, []string{"itunesadvisory", "itunesstik"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(testFileOpts{items: items}))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.Write(tt.tags, tt.delStrings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			read, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string][]byte{"rtng": tt.rtng, "stik": tt.stik} {
+				var found []*MP4Item
+				for _, item := range read {
+					if item.Name == name {
+						found = append(found, item)
+					}
+				}
+				if want == nil {
+					if len(found) != 0 {
+						t.Errorf("%s wasn't deleted: %v", name, found)
+					}
+					continue
+				}
+				if len(found) != 1 || !bytes.Equal(found[0].Data, want) {
+					t.Errorf("%s items are %v, want one with %v", name, found, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetItem(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		wantType DataType
+		wantData []byte
+		locale   uint32
+	}{
+		{"(c)nam", "title", DataTypeUTF8, []byte("title"), 0},
+		{"tmpo", uint16(120), DataTypeUnsignedInt, []byte{0, 120}, 0},
+		{"xyzw", int8(-1), DataTypeSignedInt, []byte{0xFF}, 0},
+		{"abcd", []byte{9, 8, 7}, DataTypeBinary, []byte{9, 8, 7}, 0},
+		{"----:com.apple.iTunes:MOOD", "happy", DataTypeUTF8, []byte("happy"), 0},
+		{"desc", &MP4Item{Type: DataTypeUTF8, Locale: 42, Data: []byte("hi")}, DataTypeUTF8, []byte("hi"), 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(testFileOpts{}))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.SetItem(tt.name, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			items, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			item := findItem(items, tt.name)
+			if item == nil {
+				t.Fatal("item wasn't written")
+			}
+			if item.Type != tt.wantType || item.Locale != tt.locale || !bytes.Equal(item.Data, tt.wantData) {
+				t.Errorf("item is %+v", item)
+			}
+
+			err = mp4.SetItem(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			items, err = mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if findItem(items, tt.name) != nil {
+				t.Error("item wasn't deleted")
+			}
+		})
+	}
+}
+
+func TestPictureTypesKept(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType DataType
+		format   ImageType
+	}{
+		{"jpeg", DataTypeJPEG, ImageTypeJPEG},
+		{"png", DataTypePNG, ImageTypePNG},
+		{"bmp", DataTypeBMP, ImageTypeBMP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			covr := testItem("covr", tt.dataType, []byte("picture data"))
+			path := writeTestFile(t, makeTestFile(testFileOpts{items: [][]byte{covr}}))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.Write(&MP4Tags{Title: "title"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tags.Pictures) != 1 || tags.Pictures[0].Format != tt.format {
+				t.Fatalf("pictures are %v", tags.Pictures)
+			}
+			items, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			item := findItem(items, "covr")
+			if item == nil || item.Type != tt.dataType {
+				t.Errorf("covr item is %v", item)
+			}
+		})
+	}
+}
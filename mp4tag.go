@@ -1,7 +1,7 @@
 package mp4tag
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
@@ -11,7 +11,30 @@ func (mp4 *MP4) UpperCustom(b bool) {
 	mp4.upperCustom = b
 }
 
+// Padding sets how many bytes of free space to reserve after the tags when
+// the whole file has to be rewritten, so that later writes that fit can be
+// done in place. Defaults to 0.
+func (mp4 *MP4) Padding(size int64) {
+	mp4.padding = size
+}
+
+// Strict only allows files with one of the major brands M4A, M4B, dash,
+// mp41, mp42, isom, iso2 and avc1 to be read or written. Defaults to false,
+// where any file with an ISO BMFF brand is allowed.
+func (mp4 *MP4) Strict(b bool) {
+	mp4.strict = b
+}
+
+// Ftyp returns the file's major brand, minor version and compatible brands,
+// or nil for QuickTime files without ftyp.
+func (mp4 *MP4) Ftyp() *MP4Ftyp {
+	return mp4.ftyp
+}
+
 func (mp4 *MP4) Close() error {
+	if mp4.f == nil {
+		return nil
+	}
 	return mp4.f.Close()
 }
 
@@ -20,6 +43,155 @@ func (mp4 *MP4) Read() (*MP4Tags, error) {
 	return tags, err
 }
 
+// Items reads every data box in ilst along with its data type, including
+// those of atoms that have their own MP4Tags fields.
+func (mp4 *MP4) Items() ([]*MP4Item, error) {
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return nil, err
+	}
+	return mp4.readItems(boxes, true)
+}
+
+// SetItem replaces the ilst atom name with one data box per value, or
+// deletes it if there are none. The data type follows the Go type of each
+// value: strings are UTF-8, ints and uints big endian, *MP4Picture JPEG, PNG
+// or BMP, and []byte binary. Pass *MP4Item values to choose the type and
+// locale. Freeform atoms are named ----:mean:name.
+func (mp4 *MP4) SetItem(name string, values ...interface{}) error {
+	var items []*MP4Item
+	for _, value := range values {
+		item, err := newItem(name, value)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	tags := &MP4Tags{RawItems: items}
+	return mp4.Write(tags, []string{"item:" + name})
+}
+
+// UserData reads the QuickTime string atoms in moov.udta, like ©nam and
+// ©xyz, with one value per string record.
+func (mp4 *MP4) UserData() ([]*MP4UserData, error) {
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return nil, err
+	}
+	return mp4.readUserData(boxes)
+}
+
+// SetUserData replaces the QuickTime atom name in moov.udta with one string
+// record per value, or deletes it if there are none. Values are strings,
+// recorded with an undetermined language, or *MP4UserData values to choose
+// the language.
+func (mp4 *MP4) SetUserData(name string, values ...interface{}) error {
+	if mp4.path == "" {
+		return &ErrNoPath{}
+	}
+	var records []*MP4UserData
+	for _, value := range values {
+		record := &MP4UserData{Name: name, Language: userDataLanguage}
+		switch v := value.(type) {
+		case string:
+			record.Value = v
+		case *MP4UserData:
+			record.Language, record.Value = v.Language, v.Value
+		default:
+			return &ErrUnsupportedItemValue{Value: value}
+		}
+		records = append(records, record)
+	}
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return err
+	}
+	changes, err := mp4.planUserData(boxes, name, records)
+	if err != nil {
+		return err
+	}
+	patches, err := mp4.applyChanges(boxes, changes)
+	if err != nil {
+		return err
+	}
+	return mp4.savePatches(patches)
+}
+
+// Metadata reads the QuickTime mdta keys in moov.meta, with one item per
+// value named after its key, like com.apple.quicktime.make. These are
+// separate from the iTunes tags in moov.udta.meta.
+func (mp4 *MP4) Metadata() ([]*MP4Item, error) {
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := mp4.readMdta(boxes)
+	if err != nil {
+		return nil, err
+	}
+	var items []*MP4Item
+	for _, key := range keys {
+		items = append(items, key.items...)
+	}
+	return items, nil
+}
+
+// SetMetadata replaces the values of an mdta key in moov.meta, adding the
+// key and any missing boxes if it's new. With no values the key is deleted
+// and the keys after it are renumbered. Values take the same types as
+// SetItem.
+func (mp4 *MP4) SetMetadata(key string, values ...interface{}) error {
+	if mp4.path == "" {
+		return &ErrNoPath{}
+	}
+	if key == "" {
+		return &ErrInvalidMetadataKey{}
+	}
+	var items []*MP4Item
+	for _, value := range values {
+		item, err := newItem(key, value)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return err
+	}
+	keys, err := mp4.readMdta(boxes)
+	if err != nil {
+		return err
+	}
+	mdta := getMdtaKey(keys, key)
+	if mdta == nil {
+		if len(items) == 0 {
+			return nil
+		}
+		mdta = &mdtaKey{namespace: "mdta", name: key}
+		keys = append(keys, mdta)
+	}
+	mdta.items = items
+	changes, err := mp4.planMdta(boxes, keys)
+	if err != nil {
+		return err
+	}
+	patches, err := mp4.applyChanges(boxes, changes)
+	if err != nil {
+		return err
+	}
+	return mp4.savePatches(patches)
+}
+
+// Properties reads the duration and format of the file and its tracks.
+func (mp4 *MP4) Properties() (*MP4Properties, error) {
+	return mp4.actualProperties()
+}
+
+// Write merges tags into the file. Rewrites go through a temp file that
+// replaces the original, but writes that fit in the existing padding are
+// made in place and aren't atomic: a crash part way through can leave the
+// tags corrupted.
 func (mp4 *MP4) Write(tags *MP4Tags, delStrings []string) error {
 	if tags == nil && len(delStrings) == 0 {
 		return nil
@@ -28,27 +200,114 @@ func (mp4 *MP4) Write(tags *MP4Tags, delStrings []string) error {
 	return err
 }
 
+// WriteTo writes the whole file with the merged tags to w instead of
+// replacing the source file. The source is left untouched.
+func (mp4 *MP4) WriteTo(w io.Writer, tags *MP4Tags, delStrings []string) error {
+	return mp4.actualWriteTo(w, tags, delStrings)
+}
+
+// Walks the top-level boxes looking for ftyp, so leading wide, free or skip
+// boxes are skipped. QuickTime files without ftyp are allowed if they have
+// a moov.
 func (mp4 *MP4) checkHeader() error {
-	buf := make([]byte, 8)
-	_, err := mp4.f.Seek(4, io.SeekStart)
-	if err != nil {
-		return err
+	var (
+		pos     int64
+		hasMoov bool
+	)
+	for pos+8 <= mp4.size {
+		_, err := mp4.r.Seek(pos, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		boxSizeI32, err := mp4.readI32BE()
+		if err != nil {
+			return err
+		}
+		boxName, err := mp4.readString(4)
+		if err != nil {
+			return err
+		}
+		if !isBoxName(boxName) {
+			return &ErrInvalidMagic{}
+		}
+		var headerSize int64 = 8
+		boxSize := int64(uint32(boxSizeI32))
+		switch boxSize {
+		case 0:
+			boxSize = mp4.size - pos
+		case 1:
+			boxSize, err = mp4.readI64BE()
+			if err != nil {
+				return err
+			}
+			headerSize = 16
+		}
+		if boxSize < headerSize {
+			return &ErrInvalidMagic{}
+		}
+		// Truncated files can end partway through mdat.
+		if pos+boxSize > mp4.size {
+			break
+		}
+		switch boxName {
+		case "ftyp":
+			return mp4.readFtyp(boxSize - headerSize)
+		case "moov":
+			hasMoov = true
+		}
+		pos += boxSize
 	}
-	_, err = io.ReadFull(mp4.f, buf)
+	if !hasMoov {
+		return &ErrInvalidMagic{}
+	}
+	return nil
+}
+
+// Reads the ftyp payload and checks that one of its brands is ISO BMFF.
+func (mp4 *MP4) readFtyp(size int64) error {
+	if size < 8 {
+		return &ErrInvalidMagic{}
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(mp4.r, buf)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(buf[:4], []byte{0x66, 0x74, 0x79, 0x70}) {
-		return &ErrInvalidMagic{}
+	ftyp := &MP4Ftyp{
+		MajorBrand:   string(buf[:4]),
+		MinorVersion: binary.BigEndian.Uint32(buf[4:]),
 	}
-	for _, ftyp := range ftyps {
-		if bytes.Equal(buf[4:], ftyp) {
+	for i := 8; i+4 <= len(buf); i += 4 {
+		ftyp.CompatibleBrands = append(ftyp.CompatibleBrands, string(buf[i:i+4]))
+	}
+	mp4.ftyp = ftyp
+	if isISOBrand(ftyp.MajorBrand) {
+		return nil
+	}
+	for _, brand := range ftyp.CompatibleBrands {
+		if isISOBrand(brand) {
 			return nil
 		}
 	}
 	return &ErrUnsupportedFtyp{
-		Msg: "unsupported ftyp: " + fmt.Sprintf("%x", buf[4:]),
+		Msg: "unsupported ftyp: " + fmt.Sprintf("%x", buf[:4]),
+	}
+}
+
+// Checks the major brand against the strict allowlist if strict mode is on.
+func (mp4 MP4) checkStrict() error {
+	if !mp4.strict {
+		return nil
+	}
+	if mp4.ftyp == nil {
+		return &ErrUnsupportedFtyp{Msg: "ftyp box not present"}
+	}
+	if containsStr(ftyps, mp4.ftyp.MajorBrand) {
+		return nil
+	}
+	return &ErrUnsupportedFtyp{
+		Msg: "unsupported ftyp: " + fmt.Sprintf("%x", mp4.ftyp.MajorBrand),
 	}
 }
 
@@ -64,6 +323,7 @@ func Open(trackPath string) (*MP4, error) {
 	}
 
 	mp4 := &MP4{
+		r:           f,
 		f:           f,
 		size:        stat.Size(),
 		path:        trackPath,
@@ -76,3 +336,39 @@ func Open(trackPath string) (*MP4, error) {
 	}
 	return mp4, nil
 }
+
+// OpenReader opens an MP4 from any io.ReadSeeker, such as an in-memory buffer.
+// size is the total length of the stream. Write isn't available on MP4s
+// opened this way as there's no file to replace.
+func OpenReader(r io.ReadSeeker, size int64) (*MP4, error) {
+	mp4 := &MP4{
+		r:           r,
+		size:        size,
+		upperCustom: true,
+	}
+	err := mp4.checkHeader()
+	if err != nil {
+		return nil, err
+	}
+	return mp4, nil
+}
+
+// String returns the genre's name, or "" if the code isn't in the table.
+func (genre Genre) String() string {
+	return displayGenre[genre]
+}
+
+// GenreByName looks up a genre from its name, such as a CustomGenre value.
+// Case, spacing and punctuation are ignored, and "&" or "+" match "and".
+func GenreByName(name string) (Genre, bool) {
+	name = normaliseGenreName(name)
+	if name == "" {
+		return GenreNone, false
+	}
+	for genre, displayName := range displayGenre {
+		if normaliseGenreName(displayName) == name {
+			return genre, true
+		}
+	}
+	return GenreNone, false
+}
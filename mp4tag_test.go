@@ -0,0 +1,461 @@
+package mp4tag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testBox(name string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	return append(append(putI32BE(int32(len(data)+8)), name...), data...)
+}
+
+func testFullBox(name string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := putI32BE(int32(flags))
+	header[0] = version
+	return testBox(name, append([][]byte{header}, payload...)...)
+}
+
+func testItem(name string, dataType DataType, value []byte) []byte {
+	boxName, _ := getAtomName(name)
+	data := append(putI32BE(int32(dataType)), make([]byte, 4)...)
+	return testBox(string(boxName), testBox("data", data, value))
+}
+
+type testFileOpts struct {
+	tracks     int
+	co64       bool
+	mdatFirst  bool
+	largeMdat  bool // 64-bit largesize header
+	zeroMdat   bool // size 0, runs to the end of the file
+	items      [][]byte
+	noUdta     bool
+	metaExtra  []byte // after ilst in meta
+	udtaExtra  []byte // after meta in udta
+	moovExtra  []byte // after udta in moov
+	afterMoov  []byte // between moov and mdat
+	beforeMoov []byte // before ftyp
+}
+
+// Every sample starts with this, then the track and sample numbers.
+const testSampleMagic = "SMPL"
+
+const testSamples = 3
+
+func makeTestSample(track, sample int) []byte {
+	return []byte(fmt.Sprintf("%s%02d%02d", testSampleMagic, track, sample))
+}
+
+func makeTestMoov(opts testFileOpts, offsets [][]int64) []byte {
+	var traks [][]byte
+	for track := 0; track < opts.tracks; track++ {
+		var co []byte
+		if opts.co64 {
+			co = putI32BE(int32(len(offsets[track])))
+			for _, offset := range offsets[track] {
+				co = append(co, putI64BE(offset)...)
+			}
+			co = testFullBox("co64", 0, 0, co)
+		} else {
+			co = putI32BE(int32(len(offsets[track])))
+			for _, offset := range offsets[track] {
+				co = append(co, putI32BE(int32(offset))...)
+			}
+			co = testFullBox("stco", 0, 0, co)
+		}
+		stbl := testBox("stbl",
+			testFullBox("stsd", 0, 0, putI32BE(0)),
+			testFullBox("stts", 0, 0, putI32BE(1), putI32BE(testSamples), putI32BE(1024)),
+			testFullBox("stsc", 0, 0, putI32BE(1), putI32BE(1), putI32BE(1), putI32BE(1)),
+			testFullBox("stsz", 0, 0, putI32BE(8), putI32BE(testSamples)),
+			co,
+		)
+		hdlr := testFullBox("hdlr", 0, 0, make([]byte, 4), []byte("soun"), make([]byte, 13))
+		mdhd := testFullBox("mdhd", 0, 0, make([]byte, 8), putI32BE(44100), putI32BE(44100*3), make([]byte, 4))
+		tkhd := testFullBox("tkhd", 0, 7, make([]byte, 8), putI32BE(int32(track+1)), make([]byte, 68))
+		traks = append(traks, testBox("trak", tkhd, testBox("mdia", mdhd, hdlr, testBox("minf", stbl))))
+	}
+	mvhd := testFullBox("mvhd", 0, 0, make([]byte, 8), putI32BE(1000), putI32BE(3000), make([]byte, 80))
+	var udta []byte
+	if !opts.noUdta {
+		hdlr := testFullBox("hdlr", 0, 0, make([]byte, 4), []byte("mdirappl"), make([]byte, 9))
+		meta := testFullBox("meta", 0, 0, hdlr, testBox("ilst", opts.items...), opts.metaExtra)
+		udta = testBox("udta", meta, opts.udtaExtra)
+	}
+	return testBox("moov", mvhd, bytes.Join(traks, nil), udta, opts.moovExtra)
+}
+
+func makeTestMdat(opts testFileOpts, start int64) ([]byte, [][]int64) {
+	var (
+		payload []byte
+		offsets [][]int64
+	)
+	var headerSize int64 = 8
+	if opts.largeMdat {
+		headerSize = 16
+	}
+	for track := 0; track < opts.tracks; track++ {
+		offsets = append(offsets, nil)
+		for sample := 0; sample < testSamples; sample++ {
+			offsets[track] = append(offsets[track], start+headerSize+int64(len(payload)))
+			payload = append(payload, makeTestSample(track, sample)...)
+		}
+	}
+	switch {
+	case opts.largeMdat:
+		header := append(putI32BE(1), "mdat"...)
+		header = append(header, putI64BE(int64(len(payload))+16)...)
+		return append(header, payload...), offsets
+	case opts.zeroMdat:
+		return append(append(putI32BE(0), "mdat"...), payload...), offsets
+	}
+	return testBox("mdat", payload), offsets
+}
+
+func makeTestFile(opts testFileOpts) []byte {
+	if opts.tracks == 0 {
+		opts.tracks = 1
+	}
+	ftyp := testBox("ftyp", []byte("M4A "), make([]byte, 4), []byte("M4A mp42isom"))
+	head := append(append([]byte{}, opts.beforeMoov...), ftyp...)
+	if opts.mdatFirst {
+		mdat, offsets := makeTestMdat(opts, int64(len(head)))
+		moov := makeTestMoov(opts, offsets)
+		return bytes.Join([][]byte{head, mdat, moov}, nil)
+	}
+	placeholder := make([][]int64, opts.tracks)
+	for track := range placeholder {
+		placeholder[track] = make([]int64, testSamples)
+	}
+	moovSize := len(makeTestMoov(opts, placeholder))
+	mdat, offsets := makeTestMdat(opts, int64(len(head)+moovSize+len(opts.afterMoov)))
+	moov := makeTestMoov(opts, offsets)
+	return bytes.Join([][]byte{head, moov, opts.afterMoov, mdat}, nil)
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.m4a")
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type testNode struct {
+	path       string
+	start, end int64
+	headerSize int64
+}
+
+var testContainers = []string{
+	"moov", "trak", "mdia", "minf", "stbl", "udta", "meta", "ilst",
+	"tref", "moof", "traf", "mfra",
+}
+
+// Walks the box tree independently of readBoxes, failing if any box
+// overruns its parent or leaves a gap at its end.
+func walkTestBoxes(t *testing.T, data []byte, start, end int64, path string, nodes []testNode) []testNode {
+	t.Helper()
+	pos := start
+	for pos < end {
+		// A QuickTime zero terminator may end a container.
+		if path != "" && end-pos == 4 && binary.BigEndian.Uint32(data[pos:]) == 0 {
+			break
+		}
+		if end-pos < 8 {
+			t.Fatalf("%d stray bytes at %d in %q", end-pos, pos, path)
+		}
+		size := int64(binary.BigEndian.Uint32(data[pos:]))
+		name := string(data[pos+4 : pos+8])
+		var headerSize int64 = 8
+		switch size {
+		case 0:
+			if path != "" {
+				t.Fatalf("zero size box %q at %d in %q", name, pos, path)
+			}
+			size = end - pos
+		case 1:
+			size = int64(binary.BigEndian.Uint64(data[pos+8:]))
+			headerSize = 16
+		}
+		if size < headerSize || pos+size > end {
+			t.Fatalf("bad box %q size %d at %d (parent %q ends at %d)", name, size, pos, path, end)
+		}
+		boxPath := strings.TrimPrefix(path+"."+name, ".")
+		nodes = append(nodes, testNode{boxPath, pos, pos + size, headerSize})
+		childStart := pos + headerSize
+		if name == "meta" && string(data[childStart+4:childStart+8]) != "hdlr" {
+			childStart += 4
+		}
+		if strings.HasSuffix(path, ".ilst") || containsStr(testContainers, name) {
+			nodes = walkTestBoxes(t, data, childStart, pos+size, boxPath, nodes)
+		}
+		pos += size
+	}
+	return nodes
+}
+
+// Parses the file, checks its box tree and that every sound track chunk
+// offset still points at the sample it was made for.
+func checkTestFile(t *testing.T, path string) []testNode {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := walkTestBoxes(t, data, 0, int64(len(data)), "", nil)
+	var (
+		trak    testNode
+		handler string
+	)
+	for _, node := range nodes {
+		switch node.path {
+		case "moov.trak":
+			trak, handler = node, ""
+		case "moov.trak.mdia.hdlr":
+			handler = string(data[node.start+16 : node.start+20])
+		case "moov.trak.mdia.minf.stbl.stco", "moov.trak.mdia.minf.stbl.co64":
+			if handler != "soun" || node.start < trak.start || node.end > trak.end {
+				continue
+			}
+			entrySize := int64(4)
+			if strings.HasSuffix(node.path, "co64") {
+				entrySize = 8
+			}
+			count := int64(binary.BigEndian.Uint32(data[node.start+12:]))
+			for idx := int64(0); idx < count; idx++ {
+				at := node.start + 16 + idx*entrySize
+				offset := getIntBE(data[at:at+entrySize], false)
+				if offset+4 > int64(len(data)) || string(data[offset:offset+4]) != testSampleMagic {
+					t.Errorf("%s entry %d points at %d, not a sample", node.path, idx, offset)
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+func hasTestNode(nodes []testNode, path string) bool {
+	for _, node := range nodes {
+		if node.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// A fragmented file with one sound track: moov, then a moof whose tfhd has
+// a base data offset, its mdat and an mfra with version 0 and 1 tfras.
+func makeTestFragFile() []byte {
+	ftyp := testBox("ftyp", []byte("iso6"), make([]byte, 4), []byte("iso6mp41"))
+	stbl := testBox("stbl",
+		testFullBox("stsd", 0, 0, putI32BE(0)),
+		testFullBox("stts", 0, 0, putI32BE(0)),
+		testFullBox("stsc", 0, 0, putI32BE(0)),
+		testFullBox("stsz", 0, 0, putI32BE(0), putI32BE(0)),
+		testFullBox("stco", 0, 0, putI32BE(0)),
+	)
+	hdlr := testFullBox("hdlr", 0, 0, make([]byte, 4), []byte("soun"), make([]byte, 13))
+	mdhd := testFullBox("mdhd", 0, 0, make([]byte, 8), putI32BE(44100), putI32BE(0), make([]byte, 4))
+	tkhd := testFullBox("tkhd", 0, 7, make([]byte, 8), putI32BE(1), make([]byte, 68))
+	trak := testBox("trak", tkhd, testBox("mdia", mdhd, hdlr, testBox("minf", stbl)))
+	mvhd := testFullBox("mvhd", 0, 0, make([]byte, 8), putI32BE(1000), putI32BE(0), make([]byte, 80))
+	mvex := testBox("mvex", testFullBox("trex", 0, 0, putI32BE(1), make([]byte, 16)))
+	metaHdlr := testFullBox("hdlr", 0, 0, make([]byte, 4), []byte("mdirappl"), make([]byte, 9))
+	udta := testBox("udta", testFullBox("meta", 0, 0, metaHdlr, testBox("ilst")))
+	moov := testBox("moov", mvhd, trak, mvex, udta)
+
+	var samples []byte
+	for sample := 0; sample < testSamples; sample++ {
+		samples = append(samples, makeTestSample(0, sample)...)
+	}
+	moofStart := int64(len(ftyp) + len(moov))
+	makeMoof := func(base int64) []byte {
+		tfhd := testFullBox("tfhd", 0, 1, putI32BE(1), putI64BE(base))
+		trun := testFullBox("trun", 0, 0, putI32BE(testSamples))
+		return testBox("moof", testFullBox("mfhd", 0, 0, putI32BE(1)), testBox("traf", tfhd, trun))
+	}
+	moof := makeMoof(0)
+	moof = makeMoof(moofStart + int64(len(moof)) + 8)
+	mdat := testBox("mdat", samples)
+	tfra0 := testFullBox("tfra", 0, 0, putI32BE(1), putI32BE(0), putI32BE(1),
+		putI32BE(0), putI32BE(int32(moofStart)), []byte{1, 1, 1})
+	tfra1 := testFullBox("tfra", 1, 0, putI32BE(1), putI32BE(0), putI32BE(1),
+		putI64BE(0), putI64BE(moofStart), []byte{1, 1, 1})
+	mfro := testFullBox("mfro", 0, 0, putI32BE(int32(len(tfra0)+len(tfra1)+16+8)))
+	mfra := testBox("mfra", tfra0, tfra1, mfro)
+	return bytes.Join([][]byte{ftyp, moov, moof, mdat, mfra}, nil)
+}
+
+// Checks that tfhd base data offsets still point at samples and tfra
+// entries at moofs.
+func checkTestFragFile(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := checkTestFile(t, path)
+	var tfhds, tfras int
+	for _, node := range nodes {
+		switch node.path {
+		case "moof.traf.tfhd":
+			tfhds++
+			offset := int64(binary.BigEndian.Uint64(data[node.start+16:]))
+			if offset+4 > int64(len(data)) || string(data[offset:offset+4]) != testSampleMagic {
+				t.Errorf("tfhd base data offset %d isn't a sample", offset)
+			}
+		case "mfra.tfra":
+			tfras++
+			var offset int64
+			if data[node.start+8] == 1 {
+				offset = int64(binary.BigEndian.Uint64(data[node.start+32:]))
+			} else {
+				offset = int64(binary.BigEndian.Uint32(data[node.start+28:]))
+			}
+			if offset+8 > int64(len(data)) || string(data[offset+4:offset+8]) != "moof" {
+				t.Errorf("tfra moof offset %d isn't a moof", offset)
+			}
+		}
+	}
+	if tfhds != 1 || tfras != 2 {
+		t.Errorf("found %d tfhd and %d tfra boxes", tfhds, tfras)
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	title := testItem("(c)nam", DataTypeUTF8, []byte("title"))
+	data := makeTestFile(testFileOpts{items: [][]byte{title}})
+	mp4, err := OpenReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	tags, err := mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title != "title" {
+		t.Errorf("title is %q", tags.Title)
+	}
+	err = mp4.Write(&MP4Tags{Title: "new title"}, nil)
+	var noPathErr *ErrNoPath
+	if !errors.As(err, &noPathErr) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	title := testItem("(c)nam", DataTypeUTF8, []byte("title"))
+	data := makeTestFile(testFileOpts{items: [][]byte{title}})
+	orig := append([]byte{}, data...)
+	mp4, err := OpenReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	newTitle := strings.Repeat("t", 300)
+	var buf bytes.Buffer
+	err = mp4.WriteTo(&buf, &MP4Tags{Title: newTitle}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, orig) {
+		t.Error("source was changed")
+	}
+	checkTestFile(t, writeTestFile(t, buf.Bytes()))
+	written, err := OpenReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := written.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title != newTitle {
+		t.Errorf("title is %q", tags.Title)
+	}
+}
+
+func TestGenreByName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   Genre
+		wantOK bool
+	}{
+		{"Hard Rock", GenreHardRock, true},
+		{"hard rock", GenreHardRock, true},
+		{"Rock and Roll", GenreRockNRoll, true},
+		{"rock+roll", GenreRockNRoll, true},
+		{"Psybient", GenrePsybient, true},
+		{"Not a genre", GenreNone, false},
+		{"", GenreNone, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genre, ok := GenreByName(tt.name)
+			if genre != tt.want || ok != tt.wantOK {
+				t.Errorf("got %d, %v", genre, ok)
+			}
+		})
+	}
+}
+
+func TestBrands(t *testing.T) {
+	tests := []struct {
+		name       string
+		major      string
+		compatible string // three brands, so ftyp keeps its size
+		openOK     bool
+		strictOK   bool
+	}{
+		{"allowlisted", "mp42", "mp42isomavc1", true, true},
+		{"not allowlisted", "XAVC", "XAVCmp42iso6", true, false},
+		{"iso compatible brand", "abcd", "abcdefghiso6", true, false},
+		{"no iso brand", "abcd", "abcdefghijkl", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := makeTestFile(testFileOpts{})
+			ftyp := testBox("ftyp", []byte(tt.major), putI32BE(1), []byte(tt.compatible))
+			copy(data, ftyp)
+			mp4, err := Open(writeTestFile(t, data))
+			var ftypErr *ErrUnsupportedFtyp
+			if !tt.openOK {
+				if !errors.As(err, &ftypErr) {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			got := mp4.Ftyp()
+			if got == nil || got.MajorBrand != tt.major || got.MinorVersion != 1 ||
+				strings.Join(got.CompatibleBrands, "") != tt.compatible {
+				t.Errorf("ftyp is %+v", got)
+			}
+			_, err = mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mp4.Strict(true)
+			_, err = mp4.Read()
+			if tt.strictOK && err != nil {
+				t.Errorf("strict read failed: %v", err)
+			}
+			if !tt.strictOK && !errors.As(err, &ftypErr) {
+				t.Errorf("strict read got error %v", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,11 @@
 package mp4tag
 
-import "os"
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
 
 type ErrBoxNotPresent struct {
 	Msg string
@@ -12,8 +17,32 @@ type ErrUnsupportedFtyp struct {
 
 type ErrInvalidStcoSize struct{}
 
+type ErrInvalidTfraSize struct{}
+
+type ErrInvalidBoxSize struct{}
+
+type ErrOffsetOverflow struct{}
+
+type ErrBoxTooLarge struct{}
+
 type ErrInvalidMagic struct{}
 
+type ErrNoPath struct{}
+
+type ErrInvalidItemName struct {
+	Name string
+}
+
+type ErrUnsupportedItemValue struct {
+	Value interface{}
+}
+
+type ErrInvalidMetadataKey struct{}
+
+type ErrUnsupportedMetaHandler struct {
+	Handler string
+}
+
 func (e *ErrBoxNotPresent) Error() string {
 	return e.Msg
 }
@@ -26,30 +55,129 @@ func (_ *ErrInvalidStcoSize) Error() string {
 	return "stco size is invalid"
 }
 
+func (_ *ErrInvalidTfraSize) Error() string {
+	return "tfra size is invalid"
+}
+
+func (_ *ErrInvalidBoxSize) Error() string {
+	return "box size is invalid"
+}
+
+func (_ *ErrOffsetOverflow) Error() string {
+	return "chunk offset doesn't fit in 32 bits, the file needs co64"
+}
+
+func (_ *ErrBoxTooLarge) Error() string {
+	return "box size doesn't fit in its 32-bit header"
+}
+
 func (_ *ErrInvalidMagic) Error() string {
 	return "file header is corrupted or not an mp4 file"
 }
 
-var ftyps = [8][]byte{
-	{0x4D, 0x34, 0x41, 0x20}, // M4A
-	{0x4D, 0x34, 0x42, 0x20}, // M4B
-	{0x64, 0x61, 0x73, 0x68}, // dash
-	{0x6D, 0x70, 0x34, 0x31}, // mp41
-	{0x6D, 0x70, 0x34, 0x32}, // mp42
-	{0x69, 0x73, 0x6F, 0x6D}, // isom
-	{0x69, 0x73, 0x6F, 0x32}, // iso2
-	{0x61, 0x76, 0x63, 0x31}, // avc1
+func (_ *ErrNoPath) Error() string {
+	return "mp4 wasn't opened from a file path"
+}
+
+func (e *ErrInvalidItemName) Error() string {
+	return "item name must be 4 bytes: " + e.Name
+}
+
+func (e *ErrUnsupportedItemValue) Error() string {
+	return fmt.Sprintf("unsupported item value type: %T", e.Value)
+}
+
+func (_ *ErrInvalidMetadataKey) Error() string {
+	return "metadata key can't be empty"
 }
 
+func (e *ErrUnsupportedMetaHandler) Error() string {
+	return "moov.meta has an unsupported handler: " + e.Handler
+}
+
+// Major brands accepted in strict mode.
+var ftyps = []string{
+	"M4A ", "M4B ", "dash", "mp41", "mp42", "isom", "iso2", "avc1",
+}
+
+// Brands that mark a file as ISO BMFF, besides any starting with iso or 3g,
+// like iso6, 3gp5 and 3g2a.
+var isoBrands = []string{
+	"mp41", "mp42", "mp71", "avc1", "M4A ", "M4B ", "M4P ", "M4V ",
+	"M4VH", "M4VP", "qt  ", "dash", "msdh", "msix", "cmfc", "cmf2",
+	"f4v ", "f4p ", "f4a ", "f4b ", "MSNV", "XAVC", "mmp4", "mp4v",
+	"NDAS", "caqv", "kddi", "MQT ",
+}
+
+// Boxes holding other boxes. Every ilst atom holds data boxes too, but the
+// same names can be plain atoms elsewhere, like ©nam in a QuickTime udta.
 var containers = []string{
-	"moov", "udta", "meta", "ilst", "----", "(c)alb",
-	"aART", "(c)art", "(c)nam", "(c)cmt", "(c)gen", "gnre",
-	"(c)wrt", "(c)con", "cprt", "desc", "(c)lyr", "(c)nrt",
-	"(c)pub", "trkn", "covr", "(c)day", "disk", "(c)too",
-	"trak", "mdia", "minf", "stbl", "rtng", "plID",
-	"atID", "tmpo", "sonm", "soal", "soar", "soco",
-	"soaa", "tvsn", "tvsh", "tves", "tven", "tvnn", "stik",
-	"ldes",
+	"moov", "udta", "meta", "ilst", "trak", "mdia",
+	"minf", "stbl", "tref", "moof", "traf", "mfra",
+}
+
+// ilst atoms with their own MP4Tags fields, and the deletion strings that
+// clear them.
+var knownItems = map[string][]string{
+	"(c)alb": {"album"},
+	"aART":   {"albumartist"},
+	"(c)art": {"artist"},
+	"(c)too": {"encodingtool"},
+	"tmpo":   {"bpm"},
+	"(c)cmt": {"comment"},
+	"(c)wrt": {"composer"},
+	"(c)con": {"conductor"},
+	"cprt":   {"copyright"},
+	"----":   {"allcustom", "allothercustom"},
+	"(c)gen": {"customgenre"},
+	"gnre":   {"genre"},
+	"desc":   {"description"},
+	"ldes":   {"longdescription"},
+	"(c)lyr": {"lyrics"},
+	"(c)nrt": {"narrator"},
+	"(c)pub": {"publisher"},
+	"(c)nam": {"title"},
+	"covr":   {"allpictures"},
+	"trkn":   {"tracknumber", "tracktotal"},
+	"disk":   {"discnumber", "disctotal"},
+	"rtng":   {"itunesadvisory"},
+	"plID":   {"itunesalbumid"},
+	"atID":   {"itunesartistid"},
+	"tvsn":   {"tvseason"},
+	"tvsh":   {"tvshow"},
+	"tves":   {"tvepisodenum"},
+	"tven":   {"tvepisode"},
+	"tvnn":   {"tvnetwork"},
+	"stik":   {"itunesstik"},
+	"(c)day": {"date", "year"},
+	"sonm":   {"titlesort"},
+	"soal":   {"albumsort"},
+	"soar":   {"artistsort"},
+	"soaa":   {"albumartistsort"},
+	"soco":   {"composersort"},
+	"(c)dir": {"director"},
+	"cpil":   {"compilation"},
+	"pgap":   {"gapless"},
+	"hdvd":   {"hdvideo"},
+	"shwm":   {"showmovement"},
+	"(c)wrk": {"work"},
+	"(c)mvn": {"movementname"},
+	"(c)mvi": {"movementnumber"},
+	"(c)mvc": {"movementcount"},
+	"(c)grp": {"grouping"},
+	"keyw":   {"keywords"},
+	"catg":   {"category"},
+	"pcst":   {"podcast"},
+	"purl":   {"podcasturl"},
+	"egid":   {"episodeguid"},
+	"purd":   {"purchasedate"},
+	"cnID":   {"itunescatalogid"},
+	"geID":   {"itunesgenreid"},
+	"sfID":   {"itunesstorefrontid"},
+	"cmID":   {"itunescomposerid"},
+	"apID":   {"itunesaccount"},
+	"ownr":   {"itunesowner"},
+	"akID":   {"itunesaccountkind"},
 }
 
 // 0-9
@@ -59,16 +187,29 @@ var numbers = []rune{
 }
 
 type MP4 struct {
-	f           *os.File
+	r           io.ReadSeeker
+	f           *os.File // nil when opened with OpenReader
 	path        string
 	size        int64
 	upperCustom bool
+	padding     int64
+	strict      bool
+	ftyp        *MP4Ftyp
+}
+
+type MP4Ftyp struct {
+	MajorBrand       string
+	MinorVersion     uint32
+	CompatibleBrands []string
 }
 
 type MP4Box struct {
 	StartOffset int64
 	EndOffset   int64
 	BoxSize     int64
+	HeaderSize  int64 // 16 if the size is a 64-bit largesize
+	ToEOF       bool  // size 0, the box runs to the end of the file
+	Trailer     int64 // bytes after the last child, like a QuickTime zero terminator
 	Path        string
 }
 
@@ -76,17 +217,27 @@ type MP4Boxes struct {
 	Boxes []*MP4Box
 }
 
+// Replaces source bytes [start, end) with data when writing.
+type patch struct {
+	start  int64
+	end    int64
+	data   []byte
+	parent *MP4Box // box that grows or shrinks with the patch, if any
+}
+
 type ImageType int8
 
 const (
 	ImageTypeJPEG ImageType = iota + 13
 	ImageTypePNG
 	ImageTypeAuto
+	ImageTypeBMP ImageType = 27
 )
 
 var resolveImageType = map[uint8]ImageType{
 	13: ImageTypeJPEG,
 	14: ImageTypePNG,
+	27: ImageTypeBMP,
 }
 
 type ItunesAdvisory int8
@@ -102,6 +253,25 @@ var resolveItunesAdvisory = map[uint8]ItunesAdvisory{
 	2: ItunesAdvisoryClean,
 }
 
+// iTunes account kind
+type ItunesAccountKind int8
+
+const (
+	ItunesAccountKindNone ItunesAccountKind = iota
+	ItunesAccountKindItunes
+	ItunesAccountKindAOL
+)
+
+var resolveItunesAccountKind = map[uint8]ItunesAccountKind{
+	0: ItunesAccountKindItunes,
+	1: ItunesAccountKindAOL,
+}
+
+var itunesAccountKindCodes = map[ItunesAccountKind]uint8{
+	ItunesAccountKindItunes: 0,
+	ItunesAccountKindAOL:    1,
+}
+
 // iTunes stik
 type ItunesStik int8
 
@@ -117,6 +287,8 @@ const (
 	RingTone        ItunesStik = 14
 	Podcast         ItunesStik = 21
 	iTunesU         ItunesStik = 23
+	// No stik, as no code is negative.
+	ItunesStikNone ItunesStik = -1
 )
 
 var resolveItunesStik = map[uint8]ItunesStik{
@@ -147,8 +319,9 @@ var displayItunesStik = map[ItunesStik]string{
 	iTunesU:         "iTunesU",
 }
 
-// GenreNone
-type Genre int8
+// Genres are gnre codes, the ID3v1 genre plus one. Codes outside the table
+// are kept as they are.
+type Genre int16
 
 const (
 	GenreNone Genre = iota
@@ -207,6 +380,7 @@ const (
 	GenreElectronic
 	GenrePopFolk
 	GenreEurodance
+	GenreDream
 	GenreSouthernRock
 	GenreComedy
 	GenreCull
@@ -231,170 +405,408 @@ const (
 	GenreMusical
 	GenreRockNRoll
 	GenreHardRock
+	GenreFolk
+	GenreFolkRock
+	GenreNationalFolk
+	GenreSwing
+	GenreFastFusion
+	GenreBebop
+	GenreLatin
+	GenreRevival
+	GenreCeltic
+	GenreBluegrass
+	GenreAvantgarde
+	GenreGothicRock
+	GenreProgressiveRock
+	GenrePsychedelicRock
+	GenreSymphonicRock
+	GenreSlowRock
+	GenreBigBand
+	GenreChorus
+	GenreEasyListening
+	GenreAcoustic
+	GenreHumour
+	GenreSpeech
+	GenreChanson
+	GenreOpera
+	GenreChamberMusic
+	GenreSonata
+	GenreSymphony
+	GenreBootyBass
+	GenrePrimus
+	GenrePornGroove
+	GenreSatire
+	GenreSlowJam
+	GenreClub
+	GenreTango
+	GenreSamba
+	GenreFolklore
+	GenreBallad
+	GenrePowerBallad
+	GenreRhythmicSoul
+	GenreFreestyle
+	GenreDuet
+	GenrePunkRock
+	GenreDrumSolo
+	GenreACappella
+	GenreEuroHouse
+	GenreDanceHall
+	GenreGoa
+	GenreDrumAndBass
+	GenreClubHouse
+	GenreHardcoreTechno
+	GenreTerror
+	GenreIndie
+	GenreBritPop
+	GenreAfroPunk
+	GenrePolskPunk
+	GenreBeat
+	GenreChristianGangstaRap
+	GenreHeavyMetal
+	GenreBlackMetal
+	GenreCrossover
+	GenreContemporaryChristian
+	GenreChristianRock
+	GenreMerengue
+	GenreSalsa
+	GenreThrashMetal
+	GenreAnime
+	GenreJPop
+	GenreSynthpop
+	GenreAbstract
+	GenreArtRock
+	GenreBaroque
+	GenreBhangra
+	GenreBigBeat
+	GenreBreakbeat
+	GenreChillout
+	GenreDowntempo
+	GenreDub
+	GenreEBM
+	GenreEclectic
+	GenreElectro
+	GenreElectroclash
+	GenreEmo
+	GenreExperimental
+	GenreGarage
+	GenreGlobal
+	GenreIDM
+	GenreIllbient
+	GenreIndustroGoth
+	GenreJamBand
+	GenreKrautrock
+	GenreLeftfield
+	GenreLounge
+	GenreMathRock
+	GenreNewRomantic
+	GenreNuBreakz
+	GenrePostPunk
+	GenrePostRock
+	GenrePsytrance
+	GenreShoegaze
+	GenreSpaceRock
+	GenreTropRock
+	GenreWorldMusic
+	GenreNeoclassical
+	GenreAudiobook
+	GenreAudioTheatre
+	GenreNeueDeutscheWelle
+	GenrePodcast
+	GenreIndieRock
+	GenreGFunk
+	GenreDubstep
+	GenreGarageRock
+	GenrePsybient
 )
 
-var resolveGenre = map[uint8]Genre{
-	1:  GenreBlues,
-	2:  GenreClassicRock,
-	3:  GenreCountry,
-	4:  GenreDance,
-	5:  GenreDisco,
-	6:  GenreFunk,
-	7:  GenreGrunge,
-	8:  GenreHipHop,
-	9:  GenreJazz,
-	10: GenreMetal,
-	11: GenreNewAge,
-	12: GenreOldies,
-	13: GenreOther,
-	14: GenrePop,
-	15: GenreRhythmAndBlues,
-	16: GenreRap,
-	17: GenreReggae,
-	18: GenreRock,
-	19: GenreTechno,
-	20: GenreIndustrial,
-	21: GenreAlternative,
-	22: GenreSka,
-	23: GenreDeathMetal,
-	24: GenrePranks,
-	25: GenreSoundtrack,
-	26: GenreEurotechno,
-	27: GenreAmbient,
-	28: GenreTripHop,
-	29: GenreVocal,
-	30: GenreJassAndFunk,
-	31: GenreFusion,
-	32: GenreTrance,
-	33: GenreClassical,
-	34: GenreInstrumental,
-	35: GenreAcid,
-	36: GenreHouse,
-	37: GenreGame,
-	38: GenreSoundClip,
-	39: GenreGospel,
-	40: GenreNoise,
-	41: GenreAlternativeRock,
-	42: GenreBass,
-	43: GenreSoul,
-	44: GenrePunk,
-	45: GenreSpace,
-	46: GenreMeditative,
-	47: GenreInstrumentalPop,
-	48: GenreInstrumentalRock,
-	49: GenreEthnic,
-	50: GenreGothic,
-	51: GenreDarkwave,
-	52: GenreTechnoindustrial,
-	53: GenreElectronic,
-	54: GenrePopFolk,
-	55: GenreEurodance,
-	56: GenreSouthernRock,
-	57: GenreComedy,
-	58: GenreCull,
-	59: GenreGangsta,
-	60: GenreTop40,
-	61: GenreChristianRap,
-	62: GenrePopSlashFunk,
-	63: GenreJungleMusic,
-	64: GenreNativeUS,
-	65: GenreCabaret,
-	66: GenreNewWave,
-	67: GenrePsychedelic,
-	68: GenreRave,
-	69: GenreShowtunes,
-	70: GenreTrailer,
-	71: GenreLofi,
-	72: GenreTribal,
-	73: GenreAcidPunk,
-	74: GenreAcidJazz,
-	75: GenrePolka,
-	76: GenreRetro,
-	77: GenreMusical,
-	78: GenreRockNRoll,
-	79: GenreHardRock,
+var displayGenre = map[Genre]string{
+	GenreBlues:                 "Blues",
+	GenreClassicRock:           "Classic Rock",
+	GenreCountry:               "Country",
+	GenreDance:                 "Dance",
+	GenreDisco:                 "Disco",
+	GenreFunk:                  "Funk",
+	GenreGrunge:                "Grunge",
+	GenreHipHop:                "Hip-Hop",
+	GenreJazz:                  "Jazz",
+	GenreMetal:                 "Metal",
+	GenreNewAge:                "New Age",
+	GenreOldies:                "Oldies",
+	GenreOther:                 "Other",
+	GenrePop:                   "Pop",
+	GenreRhythmAndBlues:        "R&B",
+	GenreRap:                   "Rap",
+	GenreReggae:                "Reggae",
+	GenreRock:                  "Rock",
+	GenreTechno:                "Techno",
+	GenreIndustrial:            "Industrial",
+	GenreAlternative:           "Alternative",
+	GenreSka:                   "Ska",
+	GenreDeathMetal:            "Death Metal",
+	GenrePranks:                "Pranks",
+	GenreSoundtrack:            "Soundtrack",
+	GenreEurotechno:            "Euro-Techno",
+	GenreAmbient:               "Ambient",
+	GenreTripHop:               "Trip-Hop",
+	GenreVocal:                 "Vocal",
+	GenreJassAndFunk:           "Jazz+Funk",
+	GenreFusion:                "Fusion",
+	GenreTrance:                "Trance",
+	GenreClassical:             "Classical",
+	GenreInstrumental:          "Instrumental",
+	GenreAcid:                  "Acid",
+	GenreHouse:                 "House",
+	GenreGame:                  "Game",
+	GenreSoundClip:             "Sound Clip",
+	GenreGospel:                "Gospel",
+	GenreNoise:                 "Noise",
+	GenreAlternativeRock:       "Alternative Rock",
+	GenreBass:                  "Bass",
+	GenreSoul:                  "Soul",
+	GenrePunk:                  "Punk",
+	GenreSpace:                 "Space",
+	GenreMeditative:            "Meditative",
+	GenreInstrumentalPop:       "Instrumental Pop",
+	GenreInstrumentalRock:      "Instrumental Rock",
+	GenreEthnic:                "Ethnic",
+	GenreGothic:                "Gothic",
+	GenreDarkwave:              "Darkwave",
+	GenreTechnoindustrial:      "Techno-Industrial",
+	GenreElectronic:            "Electronic",
+	GenrePopFolk:               "Pop-Folk",
+	GenreEurodance:             "Eurodance",
+	GenreDream:                 "Dream",
+	GenreSouthernRock:          "Southern Rock",
+	GenreComedy:                "Comedy",
+	GenreCull:                  "Cult",
+	GenreGangsta:               "Gangsta",
+	GenreTop40:                 "Top 40",
+	GenreChristianRap:          "Christian Rap",
+	GenrePopSlashFunk:          "Pop/Funk",
+	GenreJungleMusic:           "Jungle",
+	GenreNativeUS:              "Native American",
+	GenreCabaret:               "Cabaret",
+	GenreNewWave:               "New Wave",
+	GenrePsychedelic:           "Psychedelic",
+	GenreRave:                  "Rave",
+	GenreShowtunes:             "Showtunes",
+	GenreTrailer:               "Trailer",
+	GenreLofi:                  "Lo-Fi",
+	GenreTribal:                "Tribal",
+	GenreAcidPunk:              "Acid Punk",
+	GenreAcidJazz:              "Acid Jazz",
+	GenrePolka:                 "Polka",
+	GenreRetro:                 "Retro",
+	GenreMusical:               "Musical",
+	GenreRockNRoll:             "Rock & Roll",
+	GenreHardRock:              "Hard Rock",
+	GenreFolk:                  "Folk",
+	GenreFolkRock:              "Folk-Rock",
+	GenreNationalFolk:          "National Folk",
+	GenreSwing:                 "Swing",
+	GenreFastFusion:            "Fast Fusion",
+	GenreBebop:                 "Bebop",
+	GenreLatin:                 "Latin",
+	GenreRevival:               "Revival",
+	GenreCeltic:                "Celtic",
+	GenreBluegrass:             "Bluegrass",
+	GenreAvantgarde:            "Avantgarde",
+	GenreGothicRock:            "Gothic Rock",
+	GenreProgressiveRock:       "Progressive Rock",
+	GenrePsychedelicRock:       "Psychedelic Rock",
+	GenreSymphonicRock:         "Symphonic Rock",
+	GenreSlowRock:              "Slow Rock",
+	GenreBigBand:               "Big Band",
+	GenreChorus:                "Chorus",
+	GenreEasyListening:         "Easy Listening",
+	GenreAcoustic:              "Acoustic",
+	GenreHumour:                "Humour",
+	GenreSpeech:                "Speech",
+	GenreChanson:               "Chanson",
+	GenreOpera:                 "Opera",
+	GenreChamberMusic:          "Chamber Music",
+	GenreSonata:                "Sonata",
+	GenreSymphony:              "Symphony",
+	GenreBootyBass:             "Booty Bass",
+	GenrePrimus:                "Primus",
+	GenrePornGroove:            "Porn Groove",
+	GenreSatire:                "Satire",
+	GenreSlowJam:               "Slow Jam",
+	GenreClub:                  "Club",
+	GenreTango:                 "Tango",
+	GenreSamba:                 "Samba",
+	GenreFolklore:              "Folklore",
+	GenreBallad:                "Ballad",
+	GenrePowerBallad:           "Power Ballad",
+	GenreRhythmicSoul:          "Rhythmic Soul",
+	GenreFreestyle:             "Freestyle",
+	GenreDuet:                  "Duet",
+	GenrePunkRock:              "Punk Rock",
+	GenreDrumSolo:              "Drum Solo",
+	GenreACappella:             "A Cappella",
+	GenreEuroHouse:             "Euro-House",
+	GenreDanceHall:             "Dance Hall",
+	GenreGoa:                   "Goa",
+	GenreDrumAndBass:           "Drum & Bass",
+	GenreClubHouse:             "Club-House",
+	GenreHardcoreTechno:        "Hardcore Techno",
+	GenreTerror:                "Terror",
+	GenreIndie:                 "Indie",
+	GenreBritPop:               "BritPop",
+	GenreAfroPunk:              "Afro-Punk",
+	GenrePolskPunk:             "Polsk Punk",
+	GenreBeat:                  "Beat",
+	GenreChristianGangstaRap:   "Christian Gangsta Rap",
+	GenreHeavyMetal:            "Heavy Metal",
+	GenreBlackMetal:            "Black Metal",
+	GenreCrossover:             "Crossover",
+	GenreContemporaryChristian: "Contemporary Christian",
+	GenreChristianRock:         "Christian Rock",
+	GenreMerengue:              "Merengue",
+	GenreSalsa:                 "Salsa",
+	GenreThrashMetal:           "Thrash Metal",
+	GenreAnime:                 "Anime",
+	GenreJPop:                  "JPop",
+	GenreSynthpop:              "Synthpop",
+	GenreAbstract:              "Abstract",
+	GenreArtRock:               "Art Rock",
+	GenreBaroque:               "Baroque",
+	GenreBhangra:               "Bhangra",
+	GenreBigBeat:               "Big Beat",
+	GenreBreakbeat:             "Breakbeat",
+	GenreChillout:              "Chillout",
+	GenreDowntempo:             "Downtempo",
+	GenreDub:                   "Dub",
+	GenreEBM:                   "EBM",
+	GenreEclectic:              "Eclectic",
+	GenreElectro:               "Electro",
+	GenreElectroclash:          "Electroclash",
+	GenreEmo:                   "Emo",
+	GenreExperimental:          "Experimental",
+	GenreGarage:                "Garage",
+	GenreGlobal:                "Global",
+	GenreIDM:                   "IDM",
+	GenreIllbient:              "Illbient",
+	GenreIndustroGoth:          "Industro-Goth",
+	GenreJamBand:               "Jam Band",
+	GenreKrautrock:             "Krautrock",
+	GenreLeftfield:             "Leftfield",
+	GenreLounge:                "Lounge",
+	GenreMathRock:              "Math Rock",
+	GenreNewRomantic:           "New Romantic",
+	GenreNuBreakz:              "Nu-Breakz",
+	GenrePostPunk:              "Post-Punk",
+	GenrePostRock:              "Post-Rock",
+	GenrePsytrance:             "Psytrance",
+	GenreShoegaze:              "Shoegaze",
+	GenreSpaceRock:             "Space Rock",
+	GenreTropRock:              "Trop Rock",
+	GenreWorldMusic:            "World Music",
+	GenreNeoclassical:          "Neoclassical",
+	GenreAudiobook:             "Audiobook",
+	GenreAudioTheatre:          "Audio Theatre",
+	GenreNeueDeutscheWelle:     "Neue Deutsche Welle",
+	GenrePodcast:               "Podcast",
+	GenreIndieRock:             "Indie Rock",
+	GenreGFunk:                 "G-Funk",
+	GenreDubstep:               "Dubstep",
+	GenreGarageRock:            "Garage Rock",
+	GenrePsybient:              "Psybient",
 }
 
-var displayGenre = map[Genre]string{
-	GenreBlues:            "Blues",
-	GenreClassicRock:      "Classic Rock",
-	GenreCountry:          "Country",
-	GenreDance:            "Dance",
-	GenreDisco:            "Disco",
-	GenreFunk:             "Funk",
-	GenreGrunge:           "Grunge",
-	GenreHipHop:           "Hip Hop",
-	GenreJazz:             "Jazz",
-	GenreMetal:            "Metal",
-	GenreNewAge:           "NewAge",
-	GenreOldies:           "Oldies",
-	GenreOther:            "Other",
-	GenrePop:              "Pop",
-	GenreRhythmAndBlues:   "Rhythm And Blues",
-	GenreRap:              "Rap",
-	GenreReggae:           "Reggae",
-	GenreRock:             "Rock",
-	GenreTechno:           "Techno",
-	GenreIndustrial:       "Industrial",
-	GenreAlternative:      "Alternative",
-	GenreSka:              "Ska",
-	GenreDeathMetal:       "Death Metal",
-	GenrePranks:           "Pranks",
-	GenreSoundtrack:       "Soundtrack",
-	GenreEurotechno:       "Eurotechno",
-	GenreAmbient:          "Ambient",
-	GenreTripHop:          "TripHop",
-	GenreVocal:            "Vocal",
-	GenreJassAndFunk:      "Jass And Funk",
-	GenreFusion:           "Fusion",
-	GenreTrance:           "Trance",
-	GenreClassical:        "Classical",
-	GenreInstrumental:     "Instrumental",
-	GenreAcid:             "Acid",
-	GenreHouse:            "House",
-	GenreGame:             "Game",
-	GenreSoundClip:        "Sound Clip",
-	GenreGospel:           "Gospel",
-	GenreNoise:            "Noise",
-	GenreAlternativeRock:  "Alternative Rock",
-	GenreBass:             "Bass",
-	GenreSoul:             "Soul",
-	GenrePunk:             "Punk",
-	GenreSpace:            "Space",
-	GenreMeditative:       "Meditative",
-	GenreInstrumentalPop:  "Instrumental Pop",
-	GenreInstrumentalRock: "Instrumental Rock",
-	GenreEthnic:           "Ethnic",
-	GenreGothic:           "Gothic",
-	GenreDarkwave:         "Darkwave",
-	GenreTechnoindustrial: "Techno Industrial",
-	GenreElectronic:       "Electronic",
-	GenrePopFolk:          "Pop Folk",
-	GenreEurodance:        "Eurodance",
-	GenreSouthernRock:     "Southern Rock",
-	GenreComedy:           "Comedy",
-	GenreCull:             "Cull",
-	GenreGangsta:          "Gangsta",
-	GenreTop40:            "Top 40",
-	GenreChristianRap:     "Christian Rap",
-	GenrePopSlashFunk:     "Pop Slash Funk",
-	GenreJungleMusic:      "Jungle Music",
-	GenreNativeUS:         "Native US",
-	GenreCabaret:          "Cabaret",
-	GenreNewWave:          "NewWave",
-	GenrePsychedelic:      "Psychedelic",
-	GenreRave:             "Rave",
-	GenreShowtunes:        "Showtunes",
-	GenreTrailer:          "Trailer",
-	GenreLofi:             "Lofi",
-	GenreTribal:           "Tribal",
-	GenreAcidPunk:         "Acid Punk",
-	GenreAcidJazz:         "Acid Jazz",
-	GenrePolka:            "Polka",
-	GenreRetro:            "Retro",
-	GenreMusical:          "Musical",
-	GenreRockNRoll:        "RockNRoll",
-	GenreHardRock:         "Hard Rock",
+var displayCodec = map[string]string{
+	"mp4a": "AAC",
+	"alac": "ALAC",
+	"ac-3": "AC-3",
+	"ec-3": "E-AC-3",
+	"Opus": "Opus",
+	"fLaC": "FLAC",
+	"lpcm": "PCM",
+	"sowt": "PCM",
+	"twos": "PCM",
+	"ipcm": "PCM",
+	"fpcm": "PCM",
+	"avc1": "H.264",
+	"avc3": "H.264",
+	"hvc1": "H.265",
+	"hev1": "H.265",
+	"mp4v": "MPEG-4 Visual",
+	"av01": "AV1",
+	"vp09": "VP9",
+	"text": "Text",
+	"tx3g": "Timed Text",
+}
+
+// esds objectTypeIndication
+var resolveObjectType = map[uint8]string{
+	0x40: "AAC",
+	0x66: "AAC",
+	0x67: "AAC",
+	0x68: "AAC",
+	0x69: "MP3",
+	0x6B: "MP3",
+	0xA5: "AC-3",
+	0xA6: "E-AC-3",
+	0xAD: "Opus",
+	0xDD: "Vorbis",
+}
+
+// AAC audio object types that aren't plain AAC.
+var resolveAudioObjectType = map[uint8]string{
+	5:  "HE-AAC",
+	29: "HE-AACv2",
+	23: "AAC-LD",
+	39: "AAC-ELD",
+}
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000,
+	22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+type MP4Track struct {
+	ID         int32
+	Type       string // handler type, soun, vide, text etc.
+	CodecTag   string // sample entry name, mp4a, alac, avc1 etc.
+	Codec      string
+	Duration   time.Duration
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	Bitrate    int // average, in bits per second
+	Width      int
+	Height     int
+}
+
+// The audio fields are from the first audio track.
+type MP4Properties struct {
+	Duration   time.Duration
+	Codec      string
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	Bitrate    int
+	Tracks     []*MP4Track
+}
+
+// A packed string record in a QuickTime moov.udta atom like ©nam. Language
+// is a Mac language code below 0x400, otherwise a packed ISO 639-2 code.
+type MP4UserData struct {
+	Name     string // (c) in place of ©, like (c)nam
+	Language uint16
+	Value    string
+}
+
+// A key in a QuickTime moov.meta keys box along with its ilst values.
+type mdtaKey struct {
+	namespace string
+	name      string
+	items     []*MP4Item
+}
+
+type MP4Chapter struct {
+	Start time.Duration
+	Title string
 }
 
 type MP4Picture struct {
@@ -402,46 +814,104 @@ type MP4Picture struct {
 	Data   []byte
 }
 
+// Type indicator of an ilst data box.
+type DataType uint32
+
+const (
+	DataTypeBinary      DataType = 0
+	DataTypeUTF8        DataType = 1
+	DataTypeUTF16       DataType = 2
+	DataTypeJPEG        DataType = 13
+	DataTypePNG         DataType = 14
+	DataTypeSignedInt   DataType = 21 // big endian, 1, 2, 3, 4 or 8 bytes
+	DataTypeUnsignedInt DataType = 22 // big endian, 1, 2, 3, 4 or 8 bytes
+	DataTypeFloat32     DataType = 23
+	DataTypeFloat64     DataType = 24
+	DataTypeBMP         DataType = 27
+	DataTypeInt8        DataType = 65
+	DataTypeInt16       DataType = 66
+	DataTypeInt32       DataType = 67
+	DataTypeInt64       DataType = 74
+	DataTypeUint8       DataType = 75
+	DataTypeUint16      DataType = 76
+	DataTypeUint32      DataType = 77
+	DataTypeUint64      DataType = 78
+)
+
+// One data box of an ilst atom. Atoms with several data boxes are split into
+// several items. Freeform atoms are named ----:mean:name.
+type MP4Item struct {
+	Name   string // box name, with (c) standing in for ©
+	Type   DataType
+	Locale uint32
+	Data   []byte
+}
+
 type MP4Tags struct {
-	Album           string // moov.udta.meta.ilst.(c)alb
-	AlbumSort       string
-	AlbumArtist     string // moov.udta.meta.ilst.aART
-	AlbumArtistSort string
-	Artist          string // moov.udta.meta.ilst.(c)art
-	ArtistSort      string
-	EncodingTool    string // moov.udta.meta.ilst.(c)too
-	BPM             int16
-	Comment         string // moov.udta.meta.ilst.(c)cmt
-	Composer        string // moov.udta.meta.ilst.(c)wrt
-	ComposerSort    string
-	Conductor       string // moov.udta.meta.ilst.(c)con
-	Copyright       string // moov.udta.meta.ilst.cprt
-	Custom          map[string]string
-	CustomGenre     string // moov.udta.meta.ilst.(c)gen
-	Date            string // moov.udta.meta.ilst.(c)day
-	Description     string // moov.udta.meta.ilst.desc
-	LongDescription string // moov.udta.meta.ilst.ldes
-	Director        string
-	DiscNumber      int16 // moov.udta.meta.ilst.disk
-	DiscTotal       int16 // moov.udta.meta.ilst.disk
-	Genre           Genre
-	ItunesAdvisory  ItunesAdvisory
-	ItunesAlbumID   int32
-	ItunesArtistID  int32
-	ItunesStik      ItunesStik // "moov.udta.meta.ilst.stik"
-	Lyrics          string     // moov.udta.meta.ilst.(c)lyr
-	Narrator        string     // moov.udta.meta.ilst.(c)nrt
-	OtherCustom     map[string][]string
-	Pictures        []*MP4Picture // "moov.udta.meta.ilst.covr"
-	Publisher       string        // moov.udta.meta.ilst.(c)pub
-	Title           string        // moov.udta.meta.ilst.(c)nam
-	TitleSort       string
-	TrackNumber     int16  // moov.udta.meta.ilst.trkn
-	TrackTotal      int16  // moov.udta.meta.ilst.trkn
-	TVNetwork       string // moov.udta.meta.ilst.tvnn
-	TVShow          string // moov.udta.meta.ilst.tvsh
-	TVEpisode       string // moov.udta.meta.ilst.tven
-	TVEpisodeNum    int16  // moov.udta.meta.ilst.tves
-	TVSeason        int16  // moov.udta.meta.ilst.tvsn
-	Year            int32
+	Album              string // moov.udta.meta.ilst.(c)alb
+	AlbumSort          string // moov.udta.meta.ilst.soal
+	AlbumArtist        string // moov.udta.meta.ilst.aART
+	AlbumArtistSort    string // moov.udta.meta.ilst.soaa
+	Artist             string // moov.udta.meta.ilst.(c)art
+	ArtistSort         string // moov.udta.meta.ilst.soar
+	EncodingTool       string // moov.udta.meta.ilst.(c)too
+	BPM                int16
+	Category           string        // moov.udta.meta.ilst.catg
+	Chapters           []*MP4Chapter // moov.udta.chpl and QuickTime chapter tracks
+	Comment            string        // moov.udta.meta.ilst.(c)cmt
+	Compilation        bool          // moov.udta.meta.ilst.cpil
+	Composer           string        // moov.udta.meta.ilst.(c)wrt
+	ComposerSort       string        // moov.udta.meta.ilst.soco
+	Conductor          string        // moov.udta.meta.ilst.(c)con
+	Copyright          string        // moov.udta.meta.ilst.cprt
+	Custom             map[string]string
+	CustomGenre        string // moov.udta.meta.ilst.(c)gen
+	Date               string // moov.udta.meta.ilst.(c)day
+	Description        string // moov.udta.meta.ilst.desc
+	LongDescription    string // moov.udta.meta.ilst.ldes
+	Director           string // moov.udta.meta.ilst.(c)dir
+	DiscNumber         int16  // moov.udta.meta.ilst.disk
+	DiscTotal          int16  // moov.udta.meta.ilst.disk
+	EpisodeGUID        string // moov.udta.meta.ilst.egid
+	Gapless            bool   // moov.udta.meta.ilst.pgap
+	Genre              Genre
+	Grouping           string            // moov.udta.meta.ilst.(c)grp
+	HDVideo            bool              // moov.udta.meta.ilst.hdvd
+	ItunesAccount      string            // moov.udta.meta.ilst.apID
+	ItunesAccountKind  ItunesAccountKind // moov.udta.meta.ilst.akID
+	ItunesAdvisory     ItunesAdvisory
+	ItunesAlbumID      int64 // moov.udta.meta.ilst.plID
+	ItunesArtistID     int32
+	ItunesCatalogID    int64      // moov.udta.meta.ilst.cnID
+	ItunesComposerID   int64      // moov.udta.meta.ilst.cmID
+	ItunesGenreID      int32      // moov.udta.meta.ilst.geID
+	ItunesOwner        string     // moov.udta.meta.ilst.ownr
+	ItunesStik         ItunesStik // "moov.udta.meta.ilst.stik"
+	ItunesStikSet      bool       // set to write a HomeVideo ItunesStik
+	Keywords           string     // moov.udta.meta.ilst.keyw
+	ItunesStorefrontID int32      // moov.udta.meta.ilst.sfID
+	Lyrics             string     // moov.udta.meta.ilst.(c)lyr
+	MovementCount      int16      // moov.udta.meta.ilst.(c)mvc
+	MovementName       string     // moov.udta.meta.ilst.(c)mvn
+	MovementNumber     int16      // moov.udta.meta.ilst.(c)mvi
+	Narrator           string     // moov.udta.meta.ilst.(c)nrt
+	OtherCustom        map[string][]string
+	Pictures           []*MP4Picture // "moov.udta.meta.ilst.covr"
+	Podcast            bool          // moov.udta.meta.ilst.pcst
+	PodcastURL         string        // moov.udta.meta.ilst.purl
+	Publisher          string        // moov.udta.meta.ilst.(c)pub
+	PurchaseDate       string        // moov.udta.meta.ilst.purd
+	RawItems           []*MP4Item    // ilst atoms not covered by another field
+	ShowMovement       bool          // moov.udta.meta.ilst.shwm
+	Title              string        // moov.udta.meta.ilst.(c)nam
+	TitleSort          string        // moov.udta.meta.ilst.sonm
+	TrackNumber        int16         // moov.udta.meta.ilst.trkn
+	TrackTotal         int16         // moov.udta.meta.ilst.trkn
+	TVNetwork          string        // moov.udta.meta.ilst.tvnn
+	TVShow             string        // moov.udta.meta.ilst.tvsh
+	TVEpisode          string        // moov.udta.meta.ilst.tven
+	TVEpisodeNum       int16         // moov.udta.meta.ilst.tves
+	TVSeason           int16         // moov.udta.meta.ilst.tvsn
+	Work               string        // moov.udta.meta.ilst.(c)wrk
+	Year               int32
 }
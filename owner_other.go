@@ -0,0 +1,9 @@
+//go:build !unix
+
+package mp4tag
+
+import "os"
+
+func copyOwner(_ *os.File, _ os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package mp4tag
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Only root can give files away, so a permission error is ignored and the
+// temp file keeps the writer's ownership.
+func copyOwner(f *os.File, stat os.FileInfo) error {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := f.Chown(int(sys.Uid), int(sys.Gid))
+	if errors.Is(err, os.ErrPermission) {
+		return nil
+	}
+	return err
+}
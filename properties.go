@@ -0,0 +1,367 @@
+package mp4tag
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Reads timescale and duration from mvhd or mdhd.
+func parseTimeHeader(buf []byte) (time.Duration, uint32) {
+	var (
+		timescale uint32
+		duration  uint64
+	)
+	if len(buf) < 20 {
+		return 0, 0
+	}
+	if buf[0] == 1 {
+		if len(buf) < 32 {
+			return 0, 0
+		}
+		timescale = binary.BigEndian.Uint32(buf[20:])
+		duration = binary.BigEndian.Uint64(buf[24:])
+	} else {
+		timescale = binary.BigEndian.Uint32(buf[12:])
+		duration = uint64(binary.BigEndian.Uint32(buf[16:]))
+	}
+	return scaleDuration(duration, timescale), timescale
+}
+
+func scaleDuration(duration uint64, timescale uint32) time.Duration {
+	if timescale == 0 || duration == 0xFFFFFFFF || duration == 0xFFFFFFFFFFFFFFFF {
+		return 0
+	}
+	secs := duration / uint64(timescale)
+	rem := duration % uint64(timescale)
+	return time.Duration(secs)*time.Second +
+		time.Duration(rem*uint64(time.Second)/uint64(timescale))
+}
+
+func parseTrackID(buf []byte) int32 {
+	offset := 12
+	if len(buf) > 0 && buf[0] == 1 {
+		offset = 20
+	}
+	if len(buf) < offset+4 {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(buf[offset:]))
+}
+
+// MPEG-4 descriptor lengths are 7 bits per byte, up to 4 bytes.
+func readDescriptor(buf []byte) (byte, []byte, []byte) {
+	if len(buf) < 2 {
+		return 0, nil, nil
+	}
+	tag := buf[0]
+	var size int
+	idx := 1
+	for ; idx < 5 && idx < len(buf); idx++ {
+		size = size<<7 | int(buf[idx]&0x7F)
+		if buf[idx]&0x80 == 0 {
+			idx++
+			break
+		}
+	}
+	if idx+size > len(buf) {
+		size = len(buf) - idx
+	}
+	return tag, buf[idx : idx+size], buf[idx+size:]
+}
+
+func parseEsds(track *MP4Track, buf []byte) {
+	if len(buf) < 4 {
+		return
+	}
+	tag, es, _ := readDescriptor(buf[4:])
+	if tag != 0x03 || len(es) < 3 {
+		return
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 && len(es) >= 2 {
+		es = es[2:]
+	}
+	if flags&0x40 != 0 && len(es) >= 1 {
+		urlLen := int(es[0])
+		if len(es) < urlLen+1 {
+			return
+		}
+		es = es[urlLen+1:]
+	}
+	if flags&0x20 != 0 && len(es) >= 2 {
+		es = es[2:]
+	}
+	tag, dec, _ := readDescriptor(es)
+	if tag != 0x04 || len(dec) < 13 {
+		return
+	}
+	codec, ok := resolveObjectType[dec[0]]
+	if ok {
+		track.Codec = codec
+	}
+	avgBitrate := binary.BigEndian.Uint32(dec[9:])
+	if avgBitrate > 0 {
+		track.Bitrate = int(avgBitrate)
+	}
+	tag, asc, _ := readDescriptor(dec[13:])
+	if tag != 0x05 || len(asc) < 2 || track.Codec != "AAC" {
+		return
+	}
+	parseAudioSpecificConfig(track, asc)
+}
+
+func parseAudioSpecificConfig(track *MP4Track, asc []byte) {
+	var bits uint64
+	for idx := 0; idx < 8; idx++ {
+		bits <<= 8
+		if idx < len(asc) {
+			bits |= uint64(asc[idx])
+		}
+	}
+	pos := 0
+	read := func(n int) int {
+		v := int(bits >> (64 - pos - n) & (1<<n - 1))
+		pos += n
+		return v
+	}
+	objectType := read(5)
+	if objectType == 31 {
+		objectType = 32 + read(6)
+	}
+	codec, ok := resolveAudioObjectType[uint8(objectType)]
+	if ok {
+		track.Codec = codec
+	}
+	freqIdx := read(4)
+	if freqIdx == 15 {
+		track.SampleRate = read(24)
+	} else if freqIdx < len(aacSampleRates) && track.SampleRate == 0 {
+		track.SampleRate = aacSampleRates[freqIdx]
+	}
+	channelConfig := read(4)
+	if channelConfig > 0 && channelConfig < 7 {
+		track.Channels = channelConfig
+	} else if channelConfig == 7 {
+		track.Channels = 8
+	}
+}
+
+func parseAlac(track *MP4Track, buf []byte) {
+	// Version and flags, then ALACSpecificConfig.
+	if len(buf) < 28 {
+		return
+	}
+	track.BitDepth = int(buf[9])
+	track.Channels = int(buf[13])
+	avgBitrate := binary.BigEndian.Uint32(buf[20:])
+	if avgBitrate > 0 {
+		track.Bitrate = int(avgBitrate)
+	}
+	track.SampleRate = int(binary.BigEndian.Uint32(buf[24:]))
+}
+
+func parseDfLa(track *MP4Track, buf []byte) {
+	// Version and flags, a metadata block header, then STREAMINFO.
+	if len(buf) < 26 || buf[4]&0x7F != 0 {
+		return
+	}
+	info := buf[8:]
+	packed := binary.BigEndian.Uint64(info[10:])
+	track.SampleRate = int(packed >> 44)
+	track.Channels = int(packed>>41&0x7) + 1
+	track.BitDepth = int(packed>>36&0x1F) + 1
+}
+
+// Opus always decodes at 48 kHz, so only the channel count is taken.
+func parseDOps(track *MP4Track, buf []byte) {
+	if len(buf) < 2 {
+		return
+	}
+	track.Channels = int(buf[1])
+}
+
+// Walks the boxes inside a sample entry.
+func parseSampleEntryChildren(track *MP4Track, buf []byte) {
+	for len(buf) >= 8 {
+		size := int(binary.BigEndian.Uint32(buf))
+		if size < 8 || size > len(buf) {
+			return
+		}
+		payload := buf[8:size]
+		switch string(buf[4:8]) {
+		case "esds":
+			parseEsds(track, payload)
+		case "alac":
+			parseAlac(track, payload)
+		case "dfLa":
+			parseDfLa(track, payload)
+		case "dOps":
+			parseDOps(track, payload)
+		}
+		buf = buf[size:]
+	}
+}
+
+func parseAudioEntry(track *MP4Track, entry []byte) {
+	if len(entry) < 28 {
+		return
+	}
+	version := binary.BigEndian.Uint16(entry[8:])
+	track.Channels = int(binary.BigEndian.Uint16(entry[16:]))
+	track.SampleRate = int(binary.BigEndian.Uint32(entry[24:]) >> 16)
+	switch track.CodecTag {
+	case "mp4a", "ac-3", "ec-3", "Opus":
+	default:
+		track.BitDepth = int(binary.BigEndian.Uint16(entry[18:]))
+	}
+	childrenAt := 28
+	switch version {
+	case 1:
+		childrenAt += 16
+	case 2:
+		// QuickTime sound description v2 stores these as wider fields.
+		childrenAt += 36
+		if len(entry) < childrenAt {
+			return
+		}
+		rate := binary.BigEndian.Uint64(entry[32:])
+		track.SampleRate = int(math.Float64frombits(rate))
+		track.Channels = int(binary.BigEndian.Uint32(entry[40:]))
+		track.BitDepth = int(binary.BigEndian.Uint32(entry[48:]))
+	}
+	if len(entry) > childrenAt {
+		parseSampleEntryChildren(track, entry[childrenAt:])
+	}
+}
+
+func parseVideoEntry(track *MP4Track, entry []byte) {
+	if len(entry) < 78 {
+		return
+	}
+	track.Width = int(binary.BigEndian.Uint16(entry[24:]))
+	track.Height = int(binary.BigEndian.Uint16(entry[26:]))
+}
+
+func parseStsd(track *MP4Track, buf []byte) {
+	// Version and flags, entry count, then the first sample entry.
+	if len(buf) < 16 {
+		return
+	}
+	entry := buf[8:]
+	size := int(binary.BigEndian.Uint32(entry))
+	if size < 8 || size > len(entry) {
+		return
+	}
+	track.CodecTag = string(entry[4:8])
+	track.Codec = displayCodec[track.CodecTag]
+	switch track.Type {
+	case "soun":
+		parseAudioEntry(track, entry[8:size])
+	case "vide":
+		parseVideoEntry(track, entry[8:size])
+	}
+}
+
+// Sums sample sizes from stsz.
+func parseStsz(buf []byte) int64 {
+	if len(buf) < 12 {
+		return 0
+	}
+	sampleSize := int64(binary.BigEndian.Uint32(buf[4:]))
+	count := int64(binary.BigEndian.Uint32(buf[8:]))
+	if sampleSize > 0 {
+		return sampleSize * count
+	}
+	var total int64
+	for idx := 12; idx+4 <= len(buf); idx += 4 {
+		total += int64(binary.BigEndian.Uint32(buf[idx:]))
+	}
+	return total
+}
+
+func (mp4 MP4) readTrack(boxes MP4Boxes, trak *MP4Box) (*MP4Track, error) {
+	track := &MP4Track{}
+	paths := []string{
+		"moov.trak.tkhd",
+		"moov.trak.mdia.hdlr",
+		"moov.trak.mdia.mdhd",
+		"moov.trak.mdia.minf.stbl.stsd",
+		"moov.trak.mdia.minf.stbl.stsz",
+	}
+	var totalSize int64
+	for _, path := range paths {
+		box := boxes.getChildBox(trak, path)
+		if box == nil {
+			continue
+		}
+		buf, err := mp4.readBoxData(box)
+		if err != nil {
+			return nil, err
+		}
+		switch path[len(path)-4:] {
+		case "tkhd":
+			track.ID = parseTrackID(buf)
+		case "hdlr":
+			if len(buf) >= 12 {
+				track.Type = string(buf[8:12])
+			}
+		case "mdhd":
+			track.Duration, _ = parseTimeHeader(buf)
+		case "stsd":
+			parseStsd(track, buf)
+		case "stsz":
+			totalSize = parseStsz(buf)
+		}
+	}
+	if track.Bitrate == 0 && totalSize > 0 && track.Duration > 0 {
+		track.Bitrate = int(float64(totalSize*8) / track.Duration.Seconds())
+	}
+	return track, nil
+}
+
+func (mp4 MP4) actualProperties() (*MP4Properties, error) {
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return nil, err
+	}
+	props := &MP4Properties{}
+	mvhd := boxes.getBoxByPath("moov.mvhd")
+	if mvhd != nil {
+		buf, err := mp4.readBoxData(mvhd)
+		if err != nil {
+			return nil, err
+		}
+		props.Duration, _ = parseTimeHeader(buf)
+	}
+
+	var (
+		audio   *MP4Track
+		longest time.Duration
+	)
+	for _, trak := range boxes.getBoxesByPath("moov.trak") {
+		track, err := mp4.readTrack(boxes, trak)
+		if err != nil {
+			return nil, err
+		}
+		if audio == nil && track.Type == "soun" {
+			audio = track
+		}
+		if track.Duration > longest {
+			longest = track.Duration
+		}
+		props.Tracks = append(props.Tracks, track)
+	}
+	if props.Duration == 0 {
+		props.Duration = longest
+	}
+	if audio != nil {
+		props.Codec = audio.Codec
+		props.SampleRate = audio.SampleRate
+		props.Channels = audio.Channels
+		props.BitDepth = audio.BitDepth
+		props.Bitrate = audio.Bitrate
+	}
+	return props, nil
+}
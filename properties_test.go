@@ -0,0 +1,59 @@
+package mp4tag
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		buf           []byte
+		wantDuration  time.Duration
+		wantTimescale uint32
+	}{
+		{"version 0", testFullBox("mvhd", 0, 0, make([]byte, 8), putI32BE(1000), putI32BE(3500))[8:], 3500 * time.Millisecond, 1000},
+		{"version 1", testFullBox("mvhd", 1, 0, make([]byte, 16), putI32BE(44100), putI64BE(44100*90))[8:], 90 * time.Second, 44100},
+		{"unknown duration", testFullBox("mvhd", 0, 0, make([]byte, 8), putI32BE(1000), putI32BE(-1))[8:], 0, 1000},
+		{"too short", make([]byte, 12), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duration, timescale := parseTimeHeader(tt.buf)
+			if duration != tt.wantDuration || timescale != tt.wantTimescale {
+				t.Errorf("got %v at %d, want %v at %d", duration, timescale, tt.wantDuration, tt.wantTimescale)
+			}
+		})
+	}
+}
+
+func TestProperties(t *testing.T) {
+	mp4, err := Open(writeTestFile(t, makeTestFile(testFileOpts{tracks: 2})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	props, err := mp4.Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mvhd is 3000 at 1000 per second, every mdhd 44100*3 at 44100.
+	if props.Duration != 3*time.Second {
+		t.Errorf("duration is %v", props.Duration)
+	}
+	if len(props.Tracks) != 2 {
+		t.Fatalf("%d tracks", len(props.Tracks))
+	}
+	for idx, track := range props.Tracks {
+		if track.ID != int32(idx+1) || track.Type != "soun" || track.Duration != 3*time.Second {
+			t.Errorf("track %d is %+v", idx, track)
+		}
+		// Three 8 byte samples over 3 seconds.
+		if track.Bitrate != 64 {
+			t.Errorf("track %d bitrate is %d", idx, track.Bitrate)
+		}
+	}
+	if props.Bitrate != 64 {
+		t.Errorf("bitrate is %d", props.Bitrate)
+	}
+}
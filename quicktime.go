@@ -0,0 +1,432 @@
+package mp4tag
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// und, packed as ISO 639-2. Used for new user data strings.
+const userDataLanguage = 0x55C4
+
+const mdtaKeyPrefix = "com.apple.quicktime."
+
+// MP4Tags fields that QuickTime files keep in moov.udta atoms or moov.meta
+// mdta keys. Either name is empty if that layout has no equivalent.
+var quickTimeFields = []struct {
+	userData string
+	key      string
+	field    func(*MP4Tags) *string
+}{
+	{"(c)nam", "title", func(tags *MP4Tags) *string { return &tags.Title }},
+	{"(c)art", "artist", func(tags *MP4Tags) *string { return &tags.Artist }},
+	{"(c)alb", "album", func(tags *MP4Tags) *string { return &tags.Album }},
+	{"(c)cmt", "comment", func(tags *MP4Tags) *string { return &tags.Comment }},
+	{"(c)com", "", func(tags *MP4Tags) *string { return &tags.Composer }},
+	{"(c)cpy", "copyright", func(tags *MP4Tags) *string { return &tags.Copyright }},
+	{"(c)day", "creationdate", func(tags *MP4Tags) *string { return &tags.Date }},
+	{"(c)des", "description", func(tags *MP4Tags) *string { return &tags.Description }},
+	{"(c)dir", "director", func(tags *MP4Tags) *string { return &tags.Director }},
+	{"(c)gen", "genre", func(tags *MP4Tags) *string { return &tags.CustomGenre }},
+	{"(c)key", "keywords", func(tags *MP4Tags) *string { return &tags.Keywords }},
+	{"(c)swr", "software", func(tags *MP4Tags) *string { return &tags.EncodingTool }},
+	{"", "publisher", func(tags *MP4Tags) *string { return &tags.Publisher }},
+}
+
+// The path of a moov.udta atom. readBoxName lowercases names after ©.
+func getUserDataPath(name string) string {
+	if strings.HasPrefix(name, "(c)") {
+		name = "(c)" + strings.ToLower(name[3:])
+	}
+	return "moov.udta." + name
+}
+
+// Reads the records of a user data atom: a 16-bit length, a 16-bit language
+// and the string. Some writers use iTunes style data boxes instead.
+func parseUserData(name string, buf []byte) []*MP4UserData {
+	var records []*MP4UserData
+	if len(buf) >= 16 && string(buf[4:8]) == "data" {
+		for _, item := range parseDataBoxes(name, buf) {
+			record := &MP4UserData{
+				Name:     name,
+				Language: userDataLanguage,
+				Value:    item.String(),
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+	for idx := 0; idx+4 <= len(buf); {
+		size := int(binary.BigEndian.Uint16(buf[idx:]))
+		if idx+4+size > len(buf) {
+			break
+		}
+		record := &MP4UserData{
+			Name:     name,
+			Language: binary.BigEndian.Uint16(buf[idx+2:]),
+			Value:    string(buf[idx+4 : idx+4+size]),
+		}
+		records = append(records, record)
+		idx += 4 + size
+	}
+	return records
+}
+
+func makeUserData(boxName []byte, records []*MP4UserData) []byte {
+	var payload []byte
+	for _, record := range records {
+		payload = append(payload, putI16BE(int16(len(record.Value)))...)
+		payload = append(payload, putI16BE(int16(record.Language))...)
+		payload = append(payload, record.Value...)
+	}
+	return makeBox(string(boxName), payload)
+}
+
+// Reads the string atoms in moov.udta, whose names start with ©.
+func (mp4 MP4) readUserData(boxes MP4Boxes) ([]*MP4UserData, error) {
+	var records []*MP4UserData
+	for _, box := range boxes.Boxes {
+		name := strings.TrimPrefix(box.Path, "moov.udta.")
+		if name == box.Path || !strings.HasPrefix(name, "(c)") || strings.Contains(name, ".") {
+			continue
+		}
+		name, err := mp4.readAtomName(box)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := mp4.readBoxData(box)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, parseUserData(name, buf)...)
+	}
+	return records, nil
+}
+
+// Replaces the user data atom name with records, deleting it if there are
+// none. The atom keeps the name it has in the file, or is added to udta.
+func (mp4 MP4) planUserData(boxes MP4Boxes, name string, records []*MP4UserData) ([]*patch, error) {
+	var changes []*patch
+	udta := boxes.getBoxByPath("moov.udta")
+	existing := boxes.getBoxesByPath(getUserDataPath(name))
+	if len(existing) > 0 {
+		var err error
+		name, err = mp4.readAtomName(existing[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	boxName, err := getAtomName(name)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if len(records) > 0 {
+		data = makeUserData(boxName, records)
+	}
+
+	for idx, box := range existing {
+		c := &patch{
+			start:  box.StartOffset,
+			end:    box.EndOffset,
+			parent: udta,
+		}
+		if idx == 0 {
+			c.data = data
+		}
+		changes = append(changes, c)
+	}
+	if len(existing) > 0 || data == nil {
+		return changes, nil
+	}
+	if udta != nil {
+		changes = append(changes, &patch{
+			start:  udta.childrenEnd(),
+			end:    udta.childrenEnd(),
+			data:   data,
+			parent: udta,
+		})
+		return changes, nil
+	}
+	moov := boxes.getBoxByPath("moov")
+	changes = append(changes, &patch{
+		start:  moov.childrenEnd(),
+		end:    moov.childrenEnd(),
+		data:   makeBox("udta", data),
+		parent: moov,
+	})
+	return changes, nil
+}
+
+// Reads the keys in moov.meta along with their ilst values. ilst atoms are
+// named after the 1-based index of their key.
+func (mp4 MP4) readMdta(boxes MP4Boxes) ([]*mdtaKey, error) {
+	keysBox := boxes.getBoxByPath("moov.meta.keys")
+	if keysBox == nil {
+		return nil, nil
+	}
+	buf, err := mp4.readBoxData(keysBox)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*mdtaKey
+	for idx := 8; idx+8 <= len(buf); {
+		size := int(binary.BigEndian.Uint32(buf[idx:]))
+		if size < 8 || idx+size > len(buf) {
+			break
+		}
+		key := &mdtaKey{
+			namespace: string(buf[idx+4 : idx+8]),
+			name:      string(buf[idx+8 : idx+size]),
+		}
+		keys = append(keys, key)
+		idx += size
+	}
+
+	ilst := boxes.getBoxByPath("moov.meta.ilst")
+	if ilst == nil {
+		return keys, nil
+	}
+	buf, err = mp4.readBoxData(ilst)
+	if err != nil {
+		return nil, err
+	}
+	for idx := 0; idx+8 <= len(buf); {
+		size := int(binary.BigEndian.Uint32(buf[idx:]))
+		if size < 8 || idx+size > len(buf) {
+			break
+		}
+		keyIdx := int(binary.BigEndian.Uint32(buf[idx+4:]))
+		if keyIdx >= 1 && keyIdx <= len(keys) {
+			key := keys[keyIdx-1]
+			key.items = append(key.items, parseDataBoxes(key.name, buf[idx+8:idx+size])...)
+		}
+		idx += size
+	}
+	return keys, nil
+}
+
+// Makes the keys and ilst boxes for keys, leaving out any without values so
+// that the rest are indexed from 1 again.
+func makeMdta(keys []*mdtaKey) ([]byte, []byte) {
+	var (
+		count       int32
+		keysPayload []byte
+		ilstPayload []byte
+	)
+	for _, key := range keys {
+		if len(key.items) == 0 {
+			continue
+		}
+		count++
+		keysPayload = append(keysPayload, makeBox(key.namespace, []byte(key.name))...)
+		var atom []byte
+		for _, item := range key.items {
+			data := putI32BE(int32(item.Type))
+			data = append(data, putI32BE(int32(item.Locale))...)
+			data = append(data, item.Data...)
+			atom = append(atom, makeBox("data", data)...)
+		}
+		ilstPayload = append(ilstPayload, makeBox(string(putI32BE(count)), atom)...)
+	}
+	keysPayload = append(putI32BE(count), keysPayload...)
+	keysPayload = append(make([]byte, 4), keysPayload...)
+	return makeBox("keys", keysPayload), makeBox("ilst", ilstPayload)
+}
+
+// The hdlr for a new moov.meta. QuickTime meta boxes have no version.
+func makeMdtaHdlr() []byte {
+	hdlr := make([]byte, 8)
+	hdlr = append(hdlr, "mdta"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	return makeBox("hdlr", hdlr)
+}
+
+func (mp4 MP4) readMetaHandler(boxes MP4Boxes) (string, error) {
+	hdlr := boxes.getBoxByPath("moov.meta.hdlr")
+	if hdlr == nil || hdlr.BoxSize < hdlr.HeaderSize+12 {
+		return "", nil
+	}
+	_, err := mp4.r.Seek(hdlr.StartOffset+hdlr.HeaderSize+8, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return mp4.readString(4)
+}
+
+// Replaces the keys and ilst boxes in moov.meta, adding whichever of them
+// and meta are missing.
+func (mp4 MP4) planMdta(boxes MP4Boxes, keys []*mdtaKey) ([]*patch, error) {
+	newKeys, newIlst := makeMdta(keys)
+	meta := boxes.getBoxByPath("moov.meta")
+	if meta == nil {
+		moov := boxes.getBoxByPath("moov")
+		metaPayload := append(makeMdtaHdlr(), newKeys...)
+		metaPayload = append(metaPayload, newIlst...)
+		c := &patch{
+			start:  moov.childrenEnd(),
+			end:    moov.childrenEnd(),
+			data:   makeBox("meta", metaPayload),
+			parent: moov,
+		}
+		return []*patch{c}, nil
+	}
+	handler, err := mp4.readMetaHandler(boxes)
+	if err != nil {
+		return nil, err
+	}
+	if handler != "mdta" {
+		return nil, &ErrUnsupportedMetaHandler{Handler: handler}
+	}
+
+	keysBox := boxes.getBoxByPath("moov.meta.keys")
+	ilst := boxes.getBoxByPath("moov.meta.ilst")
+	if keysBox == nil {
+		c := &patch{
+			start:  meta.childrenEnd(),
+			end:    meta.childrenEnd(),
+			data:   append(newKeys, newIlst...),
+			parent: meta,
+		}
+		if ilst != nil {
+			c.start, c.end = ilst.StartOffset, ilst.EndOffset
+		}
+		return []*patch{c}, nil
+	}
+	changes := []*patch{{
+		start:  keysBox.StartOffset,
+		end:    keysBox.EndOffset,
+		data:   newKeys,
+		parent: meta,
+	}}
+	ilstChange := &patch{
+		start:  meta.childrenEnd(),
+		end:    meta.childrenEnd(),
+		data:   newIlst,
+		parent: meta,
+	}
+	if ilst != nil {
+		ilstChange.start, ilstChange.end = ilst.StartOffset, ilst.EndOffset
+	}
+	return append(changes, ilstChange), nil
+}
+
+func getMdtaKey(keys []*mdtaKey, name string) *mdtaKey {
+	for _, key := range keys {
+		if key.name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// Fills in fields the iTunes tags leave empty from the QuickTime layouts,
+// preferring mdta keys over udta atoms.
+func (mp4 MP4) readQuickTimeTags(boxes MP4Boxes, tags *MP4Tags) error {
+	records, err := mp4.readUserData(boxes)
+	if err != nil {
+		return err
+	}
+	keys, err := mp4.readMdta(boxes)
+	if err != nil {
+		return err
+	}
+	for _, f := range quickTimeFields {
+		field := f.field(tags)
+		if *field != "" {
+			continue
+		}
+		key := getMdtaKey(keys, mdtaKeyPrefix+f.key)
+		if f.key != "" && key != nil {
+			for _, item := range key.items {
+				*field = item.String()
+				if *field != "" {
+					break
+				}
+			}
+		}
+		if *field != "" || f.userData == "" {
+			continue
+		}
+		for _, record := range records {
+			if getUserDataPath(record.Name) == getUserDataPath(f.userData) {
+				*field = record.Value
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Gets the fields with QuickTime copies as Read sees them, apart from the
+// iTunes tags so the fallback values aren't written into ilst.
+func (mp4 MP4) getQuickTimeTags(boxes MP4Boxes, tags *MP4Tags) (*MP4Tags, error) {
+	quickTimeTags := &MP4Tags{ItunesStik: ItunesStikNone}
+	for _, f := range quickTimeFields {
+		*f.field(quickTimeTags) = *f.field(tags)
+	}
+	err := mp4.readQuickTimeTags(boxes, quickTimeTags)
+	return quickTimeTags, err
+}
+
+// Updates or deletes the QuickTime copies of fields that a write changes.
+// QuickTime entries are only kept in sync, never added.
+func (mp4 MP4) planQuickTimeTags(boxes MP4Boxes, oldTags, newTags *MP4Tags) ([]*patch, error) {
+	var changes []*patch
+	records, err := mp4.readUserData(boxes)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := mp4.readMdta(boxes)
+	if err != nil {
+		return nil, err
+	}
+	var keysChanged bool
+	for _, f := range quickTimeFields {
+		value := *f.field(newTags)
+		if *f.field(oldTags) == value {
+			continue
+		}
+
+		key := getMdtaKey(keys, mdtaKeyPrefix+f.key)
+		if f.key != "" && key != nil {
+			item := &MP4Item{Name: key.name, Type: DataTypeUTF8, Data: []byte(value)}
+			if len(key.items) > 0 {
+				item.Locale = key.items[0].Locale
+			}
+			key.items = []*MP4Item{item}
+			if value == "" {
+				key.items = nil
+			}
+			keysChanged = true
+		}
+
+		if f.userData == "" || boxes.getBoxByPath(getUserDataPath(f.userData)) == nil {
+			continue
+		}
+		var newRecords []*MP4UserData
+		if value != "" {
+			record := &MP4UserData{Language: userDataLanguage, Value: value}
+			for _, old := range records {
+				if getUserDataPath(old.Name) == getUserDataPath(f.userData) {
+					record.Language = old.Language
+					break
+				}
+			}
+			newRecords = append(newRecords, record)
+		}
+		userDataChanges, err := mp4.planUserData(boxes, f.userData, newRecords)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, userDataChanges...)
+	}
+	if keysChanged {
+		mdtaChanges, err := mp4.planMdta(boxes, keys)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, mdtaChanges...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,280 @@
+package mp4tag
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestMetadataRenumbering(t *testing.T) {
+	keys := []string{"com.apple.quicktime.make", "com.apple.quicktime.model", "com.apple.quicktime.software"}
+	tests := []struct {
+		name   string
+		delete string
+	}{
+		{"first", keys[0]},
+		{"middle", keys[1]},
+		{"last", keys[2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(testFileOpts{}))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			for _, key := range keys {
+				err = mp4.SetMetadata(key, "value of "+key)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = mp4.SetMetadata(tt.delete)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := checkTestFile(t, path)
+			if !hasTestNode(nodes, "moov.meta.keys") || !hasTestNode(nodes, "moov.meta.ilst") {
+				t.Fatal("moov.meta is missing keys or ilst")
+			}
+
+			boxes, err := mp4.getBoxes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mdta, err := mp4.readMdta(boxes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, key := range keys {
+				if key != tt.delete {
+					want = append(want, key)
+				}
+			}
+			if len(mdta) != len(want) {
+				t.Fatalf("%d keys, want %d", len(mdta), len(want))
+			}
+			// readMdta matches ilst atoms to keys by index, so every key
+			// only has its own value if they were renumbered.
+			for idx, key := range mdta {
+				if key.name != want[idx] {
+					t.Errorf("key %d is %q, want %q", idx+1, key.name, want[idx])
+				}
+				if len(key.items) != 1 || string(key.items[0].Data) != "value of "+want[idx] {
+					t.Errorf("key %q has items %v", key.name, key.items)
+				}
+			}
+		})
+	}
+}
+
+func findUserData(records []*MP4UserData, name string) *MP4UserData {
+	for _, record := range records {
+		if record.Name == name {
+			return record
+		}
+	}
+	return nil
+}
+
+func TestUserData(t *testing.T) {
+	tests := []struct {
+		name string
+		opts testFileOpts
+	}{
+		{"udta", testFileOpts{}},
+		{"no udta", testFileOpts{noUdta: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.SetUserData("(c)nam", "quicktime title")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = mp4.SetUserData("(c)xyz", &MP4UserData{Language: 0x15C7, Value: "+51.5-000.1/"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			records, err := mp4.UserData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			title := findUserData(records, "(c)nam")
+			if title == nil || title.Value != "quicktime title" || title.Language != userDataLanguage {
+				t.Errorf("(c)nam is %+v", title)
+			}
+			location := findUserData(records, "(c)xyz")
+			if location == nil || location.Value != "+51.5-000.1/" || location.Language != 0x15C7 {
+				t.Errorf("(c)xyz is %+v", location)
+			}
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != "quicktime title" {
+				t.Errorf("title is %q", tags.Title)
+			}
+
+			// Write keeps the udta copy in sync.
+			err = mp4.Write(&MP4Tags{Title: "new title"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			records, err = mp4.UserData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			title = findUserData(records, "(c)nam")
+			if title == nil || title.Value != "new title" {
+				t.Errorf("(c)nam is %+v after write", title)
+			}
+
+			err = mp4.SetUserData("(c)nam")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			records, err = mp4.UserData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if findUserData(records, "(c)nam") != nil || findUserData(records, "(c)xyz") == nil {
+				t.Errorf("user data is %v after delete", records)
+			}
+		})
+	}
+}
+
+func TestUserDataTerminator(t *testing.T) {
+	title := makeUserData([]byte("\xA9nam"), []*MP4UserData{{Language: userDataLanguage, Value: "abc"}})
+	udta := testBox("udta", title, make([]byte, 4))
+	tests := []struct {
+		name string
+		opts testFileOpts
+	}{
+		{"mdat last", testFileOpts{noUdta: true, moovExtra: udta}},
+		// The terminator is the end of the file, so reading on would hit EOF.
+		{"moov last", testFileOpts{noUdta: true, moovExtra: udta, mdatFirst: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != "abc" {
+				t.Errorf("title is %q", tags.Title)
+			}
+
+			err = mp4.SetUserData("(c)xyz", "+51.5-000.1/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			err = mp4.Write(&MP4Tags{Title: "new title", Artist: "artist"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := checkTestFile(t, path)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, node := range nodes {
+				if node.path == "moov.udta" && !bytes.Equal(data[node.end-4:node.end], make([]byte, 4)) {
+					t.Errorf("udta doesn't end in a terminator")
+				}
+			}
+
+			records, err := mp4.UserData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record := findUserData(records, "(c)nam"); record == nil || record.Value != "new title" {
+				t.Errorf("(c)nam is %+v", record)
+			}
+			if findUserData(records, "(c)xyz") == nil {
+				t.Errorf("user data is %v", records)
+			}
+			tags, err = mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != "new title" || tags.Artist != "artist" {
+				t.Errorf("read %q and %q", tags.Title, tags.Artist)
+			}
+		})
+	}
+}
+
+func TestUserDataNotCopied(t *testing.T) {
+	title := makeUserData([]byte("\xA9nam"), []*MP4UserData{{Language: userDataLanguage, Value: "abc"}})
+	path := writeTestFile(t, makeTestFile(testFileOpts{noUdta: true, moovExtra: testBox("udta", title)}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	err = mp4.Write(&MP4Tags{Artist: "x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasItem(items, "(c)nam") || !hasItem(items, "(c)ART") {
+		t.Errorf("items are %v", items)
+	}
+	records, err := mp4.UserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := findUserData(records, "(c)nam"); record == nil || record.Value != "abc" {
+		t.Errorf("(c)nam is %+v", record)
+	}
+	tags, err := mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title != "abc" || tags.Artist != "x" {
+		t.Errorf("read %q and %q", tags.Title, tags.Artist)
+	}
+
+	err = mp4.Write(nil, []string{"title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	records, err = mp4.UserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findUserData(records, "(c)nam") != nil {
+		t.Errorf("user data is %v after delete", records)
+	}
+	items, err = mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasItem(items, "(c)nam") || !hasItem(items, "(c)ART") {
+		t.Errorf("items are %v after delete", items)
+	}
+}
@@ -27,9 +27,39 @@ func (boxes MP4Boxes) getBoxesByPath(boxPath string) []*MP4Box {
 	return outBoxes
 }
 
+// Like getBoxByPath, but only looks inside parent.
+func (boxes MP4Boxes) getChildBox(parent *MP4Box, boxPath string) *MP4Box {
+	for _, box := range boxes.Boxes {
+		if box.Path == boxPath && box.StartOffset >= parent.StartOffset &&
+			box.EndOffset <= parent.EndOffset {
+			return box
+		}
+	}
+	return nil
+}
+
+// Where new children go, before any trailer.
+func (box *MP4Box) childrenEnd() int64 {
+	return box.EndOffset - box.Trailer
+}
+
+// Reads everything in a box after its header.
+func (mp4 MP4) readBoxData(box *MP4Box) ([]byte, error) {
+	_, err := mp4.r.Seek(box.StartOffset+box.HeaderSize, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, box.BoxSize-box.HeaderSize)
+	_, err = io.ReadFull(mp4.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (mp4 MP4) readString(size int64) (string, error) {
 	buf := make([]byte, size)
-	_, err := io.ReadFull(mp4.f, buf)
+	_, err := io.ReadFull(mp4.r, buf)
 	if err != nil {
 		return "", err
 	}
@@ -38,7 +68,7 @@ func (mp4 MP4) readString(size int64) (string, error) {
 
 func (mp4 MP4) readBoxName() (string, error) {
 	buf := make([]byte, 4)
-	_, err := io.ReadFull(mp4.f, buf)
+	_, err := io.ReadFull(mp4.r, buf)
 	if err != nil {
 		return "", err
 	}
@@ -51,7 +81,7 @@ func (mp4 MP4) readBoxName() (string, error) {
 
 func (mp4 MP4) readI16BE() (int16, error) {
 	buf := make([]byte, 2)
-	_, err := io.ReadFull(mp4.f, buf)
+	_, err := io.ReadFull(mp4.r, buf)
 	if err != nil {
 		return -1, err
 	}
@@ -61,7 +91,7 @@ func (mp4 MP4) readI16BE() (int16, error) {
 
 func (mp4 MP4) readI32BE() (int32, error) {
 	buf := make([]byte, 4)
-	_, err := io.ReadFull(mp4.f, buf)
+	_, err := io.ReadFull(mp4.r, buf)
 	if err != nil {
 		return -1, err
 	}
@@ -69,15 +99,30 @@ func (mp4 MP4) readI32BE() (int32, error) {
 	return int32(num), nil
 }
 
+func (mp4 MP4) readI64BE() (int64, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(mp4.r, buf)
+	if err != nil {
+		return -1, err
+	}
+	num := binary.BigEndian.Uint64(buf)
+	return int64(num), nil
+}
+
 func (mp4 MP4) readBoxes(boxes MP4Boxes, parentEndsAt, level int64, p string) (MP4Boxes, error) {
 	empty := MP4Boxes{}
-	pos, err := getPos(mp4.f)
+	pos, err := getPos(mp4.r)
 	if err != nil {
 		return empty, err
 	}
 	if pos >= parentEndsAt {
 		return boxes, err
 	}
+	// QuickTime containers can end in a zero terminator, too short for a box.
+	if level > 0 && parentEndsAt-pos < 8 {
+		setTrailer(boxes, p[1:], parentEndsAt, parentEndsAt-pos)
+		return boxes, nil
+	}
 	boxSizeI32, err := mp4.readI32BE()
 	if err != nil {
 		return empty, err
@@ -86,30 +131,63 @@ func (mp4 MP4) readBoxes(boxes MP4Boxes, parentEndsAt, level int64, p string) (M
 	if err != nil {
 		return empty, err
 	}
-	boxSize := int64(boxSizeI32)
+	var (
+		headerSize int64 = 8
+		toEOF      bool
+	)
+	boxSize := int64(uint32(boxSizeI32))
+	switch boxSize {
+	case 0:
+		// Only top level boxes can run to the end of the file. Inside a
+		// container, it's a terminator with some trailing bytes.
+		if level > 0 {
+			setTrailer(boxes, p[1:], parentEndsAt, parentEndsAt-pos)
+			return boxes, nil
+		}
+		boxSize = parentEndsAt - pos
+		toEOF = true
+	case 1:
+		boxSize, err = mp4.readI64BE()
+		if err != nil {
+			return empty, err
+		}
+		headerSize = 16
+	}
+	if boxSize < headerSize {
+		return empty, &ErrInvalidBoxSize{}
+	}
 	endsAt := pos + boxSize
-	if boxName == "meta" {
-		_, err = mp4.f.Seek(4, io.SeekCurrent)
+	if boxName == "meta" && boxSize-headerSize >= 8 {
+		fullBox, err := mp4.isFullMeta()
 		if err != nil {
 			return empty, err
 		}
+		if fullBox {
+			_, err = mp4.r.Seek(4, io.SeekCurrent)
+			if err != nil {
+				return empty, err
+			}
+		}
 	}
+	inIlst := strings.HasSuffix(p, ".ilst")
 	p += "." + boxName
 	box := &MP4Box{
 		StartOffset: pos,
 		EndOffset:   endsAt,
 		BoxSize:     boxSize,
+		HeaderSize:  headerSize,
+		ToEOF:       toEOF,
 		Path:        p[1:],
 	}
 	boxes.Boxes = append(boxes.Boxes, box)
-	if containsStr(containers, boxName) {
+	if inIlst || containsStr(containers, boxName) {
 		boxes, err = mp4.readBoxes(boxes, endsAt, level+1, p)
 		if err != nil {
 			return empty, err
 		}
 	}
 	p = p[:len(p)-len(boxName)-1]
-	_, err = mp4.f.Seek(pos+boxSize, io.SeekStart)
+	_, err = mp4.r.Seek(pos+boxSize, io.SeekStart)
 	if err != nil {
 		return empty, err
 	}
@@ -117,17 +195,49 @@ func (mp4 MP4) readBoxes(boxes MP4Boxes, parentEndsAt, level int64, p string) (M
 	return boxes, err
 }
 
-func checkBoxes(boxes MP4Boxes) error {
-	paths := [5]string{
-		"moov", "mdat", "moov.udta", "moov.udta.meta",
-		"moov.trak.mdia.minf.stbl.stco",
-	}
-	// "moov.udta.meta.ilst"
-	for _, path := range paths {
-		if boxes.getBoxByPath(path) == nil {
-			return &ErrBoxNotPresent{Msg: path + " box not present"}
+// Records the bytes after the last child of the box at path that ends at
+// endsAt.
+func setTrailer(boxes MP4Boxes, path string, endsAt, size int64) {
+	for idx := len(boxes.Boxes) - 1; idx >= 0; idx-- {
+		box := boxes.Boxes[idx]
+		if box.Path == path && box.EndOffset == endsAt {
+			box.Trailer = size
+			return
 		}
 	}
+}
+
+// iTunes meta boxes have a version and flags, QuickTime ones go straight
+// into hdlr. Leaves the reader where it was.
+func (mp4 MP4) isFullMeta() (bool, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(mp4.r, buf)
+	if err != nil {
+		return false, err
+	}
+	_, err = mp4.r.Seek(-8, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return string(buf[4:]) != "hdlr", nil
+}
+
+func checkBoxes(boxes MP4Boxes) error {
+	if boxes.getBoxByPath("moov") == nil {
+		return &ErrBoxNotPresent{Msg: "moov box not present"}
+	}
+	// Fragmented files keep their samples in moof/mdat pairs, and init
+	// segments have no mdat at all.
+	if boxes.getBoxByPath("moov.mvex") != nil || boxes.getBoxByPath("moof") != nil {
+		return nil
+	}
+	if boxes.getBoxByPath("mdat") == nil {
+		return &ErrBoxNotPresent{Msg: "mdat box not present"}
+	}
+	if boxes.getBoxByPath("moov.trak.mdia.minf.stbl.stco") == nil &&
+		boxes.getBoxByPath("moov.trak.mdia.minf.stbl.co64") == nil {
+		return &ErrBoxNotPresent{Msg: "stco/co64 box not present"}
+	}
 	return nil
 }
 
@@ -137,7 +247,7 @@ func (mp4 MP4) readTag(boxes MP4Boxes, boxName string) (string, error) {
 	if box == nil {
 		return "", nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+16, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+16, io.SeekStart)
 	if err != nil {
 		return "", err
 	}
@@ -147,7 +257,7 @@ func (mp4 MP4) readTag(boxes MP4Boxes, boxName string) (string, error) {
 
 func (mp4 MP4) readByte() (byte, error) {
 	buf := make([]byte, 1)
-	_, err := mp4.f.Read(buf)
+	_, err := mp4.r.Read(buf)
 	if err != nil {
 		return 0x0, err
 	}
@@ -155,16 +265,8 @@ func (mp4 MP4) readByte() (byte, error) {
 }
 
 func (mp4 MP4) readBPM(boxes MP4Boxes) (int16, error) {
-	box := boxes.getBoxByPath("moov.udta.meta.ilst.tmpo.data")
-	if box == nil {
-		return -1, nil
-	}
-	_, err := mp4.f.Seek(box.StartOffset+16, io.SeekStart)
-	if err != nil {
-		return -1, err
-	}
-	bpm, err := mp4.readI16BE()
-	return bpm, err
+	bpm, err := mp4.readTagNum(boxes, "tmpo")
+	return int16(bpm), err
 }
 
 func (mp4 MP4) readPics(_boxes MP4Boxes) ([]*MP4Picture, error) {
@@ -175,7 +277,7 @@ func (mp4 MP4) readPics(_boxes MP4Boxes) ([]*MP4Picture, error) {
 	}
 	for _, box := range boxes {
 		var pic MP4Picture
-		_, err := mp4.f.Seek(box.StartOffset+11, io.SeekStart)
+		_, err := mp4.r.Seek(box.StartOffset+11, io.SeekStart)
 		if err != nil {
 			return nil, err
 		}
@@ -186,18 +288,14 @@ func (mp4 MP4) readPics(_boxes MP4Boxes) ([]*MP4Picture, error) {
 
 		imageType, ok := resolveImageType[uint8(b)]
 		if ok {
-			if imageType == ImageTypeJPEG {
-				pic.Format = ImageTypeJPEG
-			} else {
-				pic.Format = ImageTypePNG
-			}
+			pic.Format = imageType
 		}
-		_, err = mp4.f.Seek(4, io.SeekCurrent)
+		_, err = mp4.r.Seek(4, io.SeekCurrent)
 		if err != nil {
 			return nil, err
 		}
 		buf := make([]byte, box.BoxSize-16)
-		_, err = io.ReadFull(mp4.f, buf)
+		_, err = io.ReadFull(mp4.r, buf)
 		if err != nil {
 			return nil, err
 		}
@@ -213,7 +311,7 @@ func (mp4 MP4) readTrknDisk(boxes MP4Boxes, boxName string) (int16, int16, error
 	if box == nil {
 		return -1, -1, nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+18, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+18, io.SeekStart)
 	if err != nil {
 		return -1, -1, nil
 	}
@@ -230,21 +328,36 @@ func (mp4 MP4) readTrknDisk(boxes MP4Boxes, boxName string) (int16, int16, error
 }
 
 func (mp4 MP4) readTagInt16(boxes MP4Boxes, boxName string) (int16, error) {
+	num, err := mp4.readTagNum(boxes, boxName)
+	return int16(num), err
+}
+
+// Reads an int atom of any width, going by the data box's length.
+func (mp4 MP4) readTagNum(boxes MP4Boxes, boxName string) (int64, error) {
+	return mp4.readTagInt(boxes, boxName, true)
+}
+
+// Reads an unsigned int atom, like the cnID and cmID store IDs.
+func (mp4 MP4) readTagUnsigned(boxes MP4Boxes, boxName string) (int64, error) {
+	return mp4.readTagInt(boxes, boxName, false)
+}
+
+func (mp4 MP4) readTagInt(boxes MP4Boxes, boxName string, signed bool) (int64, error) {
 	path := fmt.Sprintf("moov.udta.meta.ilst.%s.data", boxName)
 	box := boxes.getBoxByPath(path)
-	if box == nil {
+	if box == nil || box.BoxSize < 17 || box.BoxSize > 24 {
 		return -1, nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+18, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+16, io.SeekStart)
 	if err != nil {
-		return -1, nil
+		return -1, err
 	}
-
-	num, err := mp4.readI16BE()
+	buf := make([]byte, box.BoxSize-16)
+	_, err = io.ReadFull(mp4.r, buf)
 	if err != nil {
-		return -1, nil
+		return -1, err
 	}
-	return num, nil
+	return getIntBE(buf, signed), nil
 }
 
 func addToOthers(others map[string][]string, key, val string) map[string][]string {
@@ -258,18 +371,53 @@ func addToOthers(others map[string][]string, key, val string) map[string][]strin
 	return others
 }
 
+// Finds the freeform atoms whose mean isn't com.apple.iTunes. These are
+// kept as items rather than read into Custom.
+func (mp4 MP4) getVendorFreeforms(boxes MP4Boxes) ([]*MP4Box, error) {
+	var vendor []*MP4Box
+	for _, box := range boxes.getBoxesByPath("moov.udta.meta.ilst.----") {
+		buf, err := mp4.readBoxData(box)
+		if err != nil {
+			return nil, err
+		}
+		mean, _ := parseFullBoxString(buf, "mean")
+		if mean != itunesMean {
+			vendor = append(vendor, box)
+		}
+	}
+	return vendor, nil
+}
+
+func isInsideAny(box *MP4Box, parents []*MP4Box) bool {
+	for _, parent := range parents {
+		if box.StartOffset >= parent.StartOffset && box.EndOffset <= parent.EndOffset {
+			return true
+		}
+	}
+	return false
+}
+
 func (mp4 MP4) readCustom(boxes MP4Boxes) (map[string]string, map[string][]string, error) {
 	var (
 		names  []string
 		values []string
 	)
+	vendor, err := mp4.getVendorFreeforms(boxes)
+	if err != nil {
+		return nil, nil, err
+	}
 	path := "moov.udta.meta.ilst.----"
-	nameBoxes := boxes.getBoxesByPath(path + ".name")
+	var nameBoxes []*MP4Box
+	for _, box := range boxes.getBoxesByPath(path + ".name") {
+		if !isInsideAny(box, vendor) {
+			nameBoxes = append(nameBoxes, box)
+		}
+	}
 	if nameBoxes == nil {
 		return nil, nil, nil
 	}
 	for _, box := range nameBoxes {
-		_, err := mp4.f.Seek(box.StartOffset+12, io.SeekStart)
+		_, err := mp4.r.Seek(box.StartOffset+12, io.SeekStart)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -293,7 +441,10 @@ func (mp4 MP4) readCustom(boxes MP4Boxes) (map[string]string, map[string][]strin
 	)
 
 	for _, box := range dataBoxes {
-		_, err := mp4.f.Seek(box.StartOffset+16, io.SeekStart)
+		if isInsideAny(box, vendor) {
+			continue
+		}
+		_, err := mp4.r.Seek(box.StartOffset+16, io.SeekStart)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -329,30 +480,21 @@ func (mp4 MP4) readCustom(boxes MP4Boxes) (map[string]string, map[string][]strin
 	return custom, others, nil
 }
 
-func (mp4 MP4) readITAlbumID(boxes MP4Boxes) (int32, error) {
-	box := boxes.getBoxByPath("moov.udta.meta.ilst.plID.data")
-	if box == nil {
-		return -1, nil
-	}
-	_, err := mp4.f.Seek(box.StartOffset+20, io.SeekStart)
-	if err != nil {
-		return -1, err
-	}
-	id, err := mp4.readI32BE()
-	return id, err
+func (mp4 MP4) readITAlbumID(boxes MP4Boxes) (int64, error) {
+	return mp4.readTagNum(boxes, "plID")
 }
 
 func (mp4 MP4) readITArtistID(boxes MP4Boxes) (int32, error) {
-	box := boxes.getBoxByPath("moov.udta.meta.ilst.atID.data")
-	if box == nil {
-		return -1, nil
-	}
-	_, err := mp4.f.Seek(box.StartOffset+16, io.SeekStart)
-	if err != nil {
-		return -1, err
+	id, err := mp4.readTagNum(boxes, "atID")
+	return int32(id), err
+}
+
+func (mp4 MP4) readAccountKind(boxes MP4Boxes) (ItunesAccountKind, error) {
+	num, err := mp4.readTagNum(boxes, "akID")
+	if err != nil || num < 0 {
+		return ItunesAccountKindNone, err
 	}
-	id, err := mp4.readI32BE()
-	return id, err
+	return resolveItunesAccountKind[uint8(num)], nil
 }
 
 func (mp4 MP4) readAdvisory(boxes MP4Boxes) (ItunesAdvisory, error) {
@@ -361,7 +503,7 @@ func (mp4 MP4) readAdvisory(boxes MP4Boxes) (ItunesAdvisory, error) {
 	if box == nil {
 		return none, nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+16, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+16, io.SeekStart)
 	if err != nil {
 		return none, err
 	}
@@ -377,12 +519,21 @@ func (mp4 MP4) readAdvisory(boxes MP4Boxes) (ItunesAdvisory, error) {
 }
 
 func (mp4 MP4) readGenre(boxes MP4Boxes) (Genre, error) {
-	none := GenreNone
-	box := boxes.getBoxByPath("moov.udta.meta.ilst.gnre.data")
-	if box == nil {
+	code, err := mp4.readTagNum(boxes, "gnre")
+	if err != nil || code < 1 {
+		return GenreNone, err
+	}
+	return Genre(code), nil
+}
+
+func (mp4 MP4) readItunesStik(boxes MP4Boxes) (ItunesStik, error) {
+	none := ItunesStikNone
+	box := boxes.getBoxByPath("moov.udta.meta.ilst.stik.data")
+	if box == nil || box.BoxSize < 17 {
 		return none, nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+17, io.SeekStart)
+	// Usually one byte, but the value is in the last byte either way.
+	_, err := mp4.r.Seek(box.EndOffset-1, io.SeekStart)
 	if err != nil {
 		return none, err
 	}
@@ -390,32 +541,35 @@ func (mp4 MP4) readGenre(boxes MP4Boxes) (Genre, error) {
 	if err != nil {
 		return none, err
 	}
-	genre, ok := resolveGenre[uint8(b)]
+	stik, ok := resolveItunesStik[uint8(b)]
 	if !ok {
 		return none, nil
 	}
-	return genre, nil
+	return stik, nil
 }
 
-func (mp4 MP4) readItunesStik(boxes MP4Boxes) (ItunesStik, error) {
-	none := Normal
-	box := boxes.getBoxByPath("moov.udta.meta.ilst.stik.data")
-	if box == nil {
-		return none, nil
+// Flags are usually one byte ints. Anything but 0 is set.
+func (mp4 MP4) readFlag(boxes MP4Boxes, boxName string) (bool, error) {
+	path := fmt.Sprintf("moov.udta.meta.ilst.%s.data", boxName)
+	box := boxes.getBoxByPath(path)
+	if box == nil || box.BoxSize < 17 {
+		return false, nil
 	}
-	_, err := mp4.f.Seek(box.StartOffset+17, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+16, io.SeekStart)
 	if err != nil {
-		return none, err
+		return false, err
 	}
-	b, err := mp4.readByte()
+	buf := make([]byte, box.BoxSize-16)
+	_, err = io.ReadFull(mp4.r, buf)
 	if err != nil {
-		return none, err
+		return false, err
 	}
-	stik, ok := resolveItunesStik[uint8(b)]
-	if !ok {
-		return none, nil
+	for _, b := range buf {
+		if b != 0x0 {
+			return true, nil
+		}
 	}
-	return stik, nil
+	return false, nil
 }
 
 func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
@@ -423,18 +577,34 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	if err != nil {
 		return nil, err
 	}
+	albumSort, err := mp4.readTag(boxes, "soal")
+	if err != nil {
+		return nil, err
+	}
 	albumArtist, err := mp4.readTag(boxes, "aART")
 	if err != nil {
 		return nil, err
 	}
+	albumArtistSort, err := mp4.readTag(boxes, "soaa")
+	if err != nil {
+		return nil, err
+	}
 	artist, err := mp4.readTag(boxes, "(c)art")
 	if err != nil {
 		return nil, err
 	}
+	artistSort, err := mp4.readTag(boxes, "soar")
+	if err != nil {
+		return nil, err
+	}
 	bpm, err := mp4.readBPM(boxes)
 	if err != nil {
 		return nil, err
 	}
+	director, err := mp4.readTag(boxes, "(c)dir")
+	if err != nil {
+		return nil, err
+	}
 	encodingTool, err := mp4.readTag(boxes, "(c)too")
 	if err != nil {
 		return nil, err
@@ -443,10 +613,30 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	if err != nil {
 		return nil, err
 	}
+	compilation, err := mp4.readFlag(boxes, "cpil")
+	if err != nil {
+		return nil, err
+	}
+	gapless, err := mp4.readFlag(boxes, "pgap")
+	if err != nil {
+		return nil, err
+	}
+	hdVideo, err := mp4.readFlag(boxes, "hdvd")
+	if err != nil {
+		return nil, err
+	}
+	showMovement, err := mp4.readFlag(boxes, "shwm")
+	if err != nil {
+		return nil, err
+	}
 	composer, err := mp4.readTag(boxes, "(c)wrt")
 	if err != nil {
 		return nil, err
 	}
+	composerSort, err := mp4.readTag(boxes, "soco")
+	if err != nil {
+		return nil, err
+	}
 	conductor, err := mp4.readTag(boxes, "(c)con")
 	if err != nil {
 		return nil, err
@@ -475,6 +665,18 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	if err != nil {
 		return nil, err
 	}
+	movementCount, err := mp4.readTagNum(boxes, "(c)mvc")
+	if err != nil {
+		return nil, err
+	}
+	movementName, err := mp4.readTag(boxes, "(c)mvn")
+	if err != nil {
+		return nil, err
+	}
+	movementNumber, err := mp4.readTagNum(boxes, "(c)mvi")
+	if err != nil {
+		return nil, err
+	}
 	narrator, err := mp4.readTag(boxes, "(c)nrt")
 	if err != nil {
 		return nil, err
@@ -483,15 +685,27 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	if err != nil {
 		return nil, err
 	}
+	work, err := mp4.readTag(boxes, "(c)wrk")
+	if err != nil {
+		return nil, err
+	}
 	title, err := mp4.readTag(boxes, "(c)nam")
 	if err != nil {
 		return nil, err
 	}
+	titleSort, err := mp4.readTag(boxes, "sonm")
+	if err != nil {
+		return nil, err
+	}
 
 	pics, err := mp4.readPics(boxes)
 	if err != nil {
 		return nil, err
 	}
+	rawItems, err := mp4.readItems(boxes, false)
+	if err != nil {
+		return nil, err
+	}
 	trackNum, trackTotal, err := mp4.readTrknDisk(boxes, "trkn")
 	if err != nil {
 		return nil, err
@@ -544,40 +758,126 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	if err != nil {
 		return nil, err
 	}
+	category, err := mp4.readTag(boxes, "catg")
+	if err != nil {
+		return nil, err
+	}
+	episodeGUID, err := mp4.readTag(boxes, "egid")
+	if err != nil {
+		return nil, err
+	}
+	grouping, err := mp4.readTag(boxes, "(c)grp")
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := mp4.readTag(boxes, "keyw")
+	if err != nil {
+		return nil, err
+	}
+	podcast, err := mp4.readFlag(boxes, "pcst")
+	if err != nil {
+		return nil, err
+	}
+	podcastURL, err := mp4.readTag(boxes, "purl")
+	if err != nil {
+		return nil, err
+	}
+	purchaseDate, err := mp4.readTag(boxes, "purd")
+	if err != nil {
+		return nil, err
+	}
+	account, err := mp4.readTag(boxes, "apID")
+	if err != nil {
+		return nil, err
+	}
+	accountKind, err := mp4.readAccountKind(boxes)
+	if err != nil {
+		return nil, err
+	}
+	catalogID, err := mp4.readTagUnsigned(boxes, "cnID")
+	if err != nil {
+		return nil, err
+	}
+	composerID, err := mp4.readTagUnsigned(boxes, "cmID")
+	if err != nil {
+		return nil, err
+	}
+	genreID, err := mp4.readTagNum(boxes, "geID")
+	if err != nil {
+		return nil, err
+	}
+	owner, err := mp4.readTag(boxes, "ownr")
+	if err != nil {
+		return nil, err
+	}
+	storefrontID, err := mp4.readTagNum(boxes, "sfID")
+	if err != nil {
+		return nil, err
+	}
 	tags := &MP4Tags{
-		Album:           album,
-		AlbumArtist:     albumArtist,
-		Artist:          artist,
-		BPM:             bpm,
-		Comment:         comment,
-		Composer:        composer,
-		Conductor:       conductor,
-		Copyright:       copyright,
-		Custom:          custom,
-		CustomGenre:     customGenre,
-		Description:     description,
-		DiscNumber:      discNum,
-		DiscTotal:       discTotal,
-		Genre:           genre,
-		ItunesAdvisory:  advisory,
-		ItunesAlbumID:   albumID,
-		ItunesArtistID:  artistID,
-		Lyrics:          lyrics,
-		Narrator:        narrator,
-		OtherCustom:     otherCustom,
-		Pictures:        pics,
-		Publisher:       publisher,
-		Title:           title,
-		TrackNumber:     trackNum,
-		TrackTotal:      trackTotal,
-		TVNetwork:       tvNetwork,
-		TVShow:          tvShow,
-		TVSeason:        tVSeason,
-		TVEpisode:       tvEpisodeID,
-		TVEpisodeNum:    tvEpisodeNum,
-		EncodingTool:    encodingTool,
-		LongDescription: longDescription,
-		ItunesStik:      iTunesStik,
+		Album:              album,
+		AlbumSort:          albumSort,
+		AlbumArtist:        albumArtist,
+		AlbumArtistSort:    albumArtistSort,
+		Artist:             artist,
+		ArtistSort:         artistSort,
+		BPM:                bpm,
+		Category:           category,
+		Comment:            comment,
+		Compilation:        compilation,
+		Composer:           composer,
+		ComposerSort:       composerSort,
+		Conductor:          conductor,
+		Copyright:          copyright,
+		Custom:             custom,
+		CustomGenre:        customGenre,
+		Description:        description,
+		Director:           director,
+		DiscNumber:         discNum,
+		DiscTotal:          discTotal,
+		EpisodeGUID:        episodeGUID,
+		Gapless:            gapless,
+		Genre:              genre,
+		Grouping:           grouping,
+		HDVideo:            hdVideo,
+		ItunesAccount:      account,
+		ItunesAccountKind:  accountKind,
+		ItunesAdvisory:     advisory,
+		ItunesAlbumID:      albumID,
+		ItunesArtistID:     artistID,
+		Keywords:           keywords,
+		ItunesStorefrontID: int32(storefrontID),
+		Lyrics:             lyrics,
+		MovementCount:      int16(movementCount),
+		MovementName:       movementName,
+		MovementNumber:     int16(movementNumber),
+		Narrator:           narrator,
+		OtherCustom:        otherCustom,
+		Pictures:           pics,
+		Podcast:            podcast,
+		PodcastURL:         podcastURL,
+		Publisher:          publisher,
+		ShowMovement:       showMovement,
+		PurchaseDate:       purchaseDate,
+		RawItems:           rawItems,
+		Title:              title,
+		TitleSort:          titleSort,
+		Work:               work,
+		TrackNumber:        trackNum,
+		TrackTotal:         trackTotal,
+		TVNetwork:          tvNetwork,
+		TVShow:             tvShow,
+		TVSeason:           tVSeason,
+		TVEpisode:          tvEpisodeID,
+		TVEpisodeNum:       tvEpisodeNum,
+		EncodingTool:       encodingTool,
+		LongDescription:    longDescription,
+		ItunesCatalogID:    catalogID,
+		ItunesComposerID:   composerID,
+		ItunesGenreID:      int32(genreID),
+		ItunesOwner:        owner,
+		ItunesStik:         iTunesStik,
+		ItunesStikSet:      iTunesStik != ItunesStikNone,
 	}
 
 	year, err := mp4.readTag(boxes, "(c)day")
@@ -600,23 +900,46 @@ func (mp4 MP4) readTags(boxes MP4Boxes) (*MP4Tags, error) {
 	return tags, nil
 }
 
-func (mp4 MP4) actualRead() (*MP4Tags, MP4Boxes, error) {
+func (mp4 MP4) getBoxes() (MP4Boxes, error) {
 	var boxes MP4Boxes
-	_, err := mp4.f.Seek(0, io.SeekStart)
+	err := mp4.checkStrict()
 	if err != nil {
-		return nil, boxes, err
+		return boxes, err
+	}
+	_, err = mp4.r.Seek(0, io.SeekStart)
+	if err != nil {
+		return boxes, err
 	}
 	boxes, err = mp4.readBoxes(boxes, mp4.size, 0, "")
 	if err != nil {
-		return nil, boxes, err
+		return boxes, err
 	}
 	err = checkBoxes(boxes)
+	return boxes, err
+}
+
+func (mp4 MP4) actualRead() (*MP4Tags, MP4Boxes, error) {
+	tags, boxes, err := mp4.readIlstTags()
 	if err != nil {
 		return nil, boxes, err
 	}
-	if boxes.getBoxByPath("moov.udta.meta.ilst") == nil {
-		return &MP4Tags{}, boxes, nil
+	err = mp4.readQuickTimeTags(boxes, tags)
+	return tags, boxes, err
+}
+
+// Reads the iTunes tags and chapters, without falling back to the
+// QuickTime ones.
+func (mp4 MP4) readIlstTags() (*MP4Tags, MP4Boxes, error) {
+	boxes, err := mp4.getBoxes()
+	if err != nil {
+		return nil, boxes, err
 	}
+	// Missing atoms read as unset, so files without ilst get the same
+	// values as ones with an empty ilst.
 	tags, err := mp4.readTags(boxes)
+	if err != nil {
+		return nil, boxes, err
+	}
+	tags.Chapters, err = mp4.readChapters(boxes)
 	return tags, boxes, err
 }
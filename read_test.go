@@ -0,0 +1,29 @@
+package mp4tag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadUntagged(t *testing.T) {
+	read := func(opts testFileOpts) *MP4Tags {
+		mp4, err := Open(writeTestFile(t, makeTestFile(opts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mp4.Close()
+		tags, err := mp4.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tags
+	}
+	tags := read(testFileOpts{noUdta: true})
+	emptyIlst := read(testFileOpts{})
+	if !reflect.DeepEqual(tags, emptyIlst) {
+		t.Errorf("untagged file read as %+v, empty ilst as %+v", tags, emptyIlst)
+	}
+	if tags.ItunesStik != ItunesStikNone || tags.TrackNumber != -1 || tags.BPM != -1 {
+		t.Errorf("untagged file read as %+v", tags)
+	}
+}
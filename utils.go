@@ -1,12 +1,11 @@
 package mp4tag
 
 import (
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"unicode"
 )
 
 func containsRune(items []rune, value rune) bool {
@@ -44,34 +43,70 @@ func containsStr(arr []string, val string) bool {
 	return false
 }
 
-func getTempPath(path string) string {
-	fname := filepath.Base(path)
-	unix := time.Now().UnixMilli()
-	tempPath := filepath.Join(
-		os.TempDir(), fmt.Sprintf("%s_tmp_%d", fname, unix))
-	return tempPath
+func getPos(s io.Seeker) (int64, error) {
+	return s.Seek(0, io.SeekCurrent)
 }
 
-func getPos(f *os.File) (int64, error) {
-	return f.Seek(0, io.SeekCurrent)
-}
-
-func moveMP4(srcPath, destPath string) error {
-	inFile, err := os.Open(srcPath)
+// Creates a temp file next to path with the same mode and owner, so it can be
+// renamed over it once written.
+func createTemp(path string) (*os.File, error) {
+	stat, err := os.Stat(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	dir, fname := filepath.Split(path)
+	f, err := os.CreateTemp(dir, "."+fname+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chmod(stat.Mode())
+	if err == nil {
+		err = copyOwner(f, stat)
 	}
-	outFile, err := os.Create(destPath)
 	if err != nil {
-		inFile.Close()
-		return err
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
 	}
-	defer outFile.Close()
-	_, err = io.Copy(outFile, inFile)
+	return f, nil
+}
+
+// Best effort, some platforms can't sync directories.
+func syncDir(path string) {
+	d, err := os.Open(filepath.Dir(path))
 	if err != nil {
-		return err
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func normaliseGenreName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r == '&' || r == '+':
+			b.WriteString("and")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func isISOBrand(brand string) bool {
+	if strings.HasPrefix(brand, "iso") || strings.HasPrefix(brand, "3g") {
+		return true
+	}
+	return containsStr(isoBrands, brand)
+}
+
+// Box names are four printable ASCII characters, or © followed by three.
+func isBoxName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if (name[i] < 0x20 || name[i] > 0x7E) && !(i == 0 && name[i] == 0xA9) {
+			return false
+		}
 	}
-	inFile.Close()
-	err = os.Remove(srcPath)
-	return err
+	return true
 }
@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,10 +16,13 @@ import (
 const BufSize = 4096 * 1024
 
 func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
+	delStrings = expandItemDelStrings(delStrings)
 	if containsStr(delStrings, "alltags") {
 		mergedPics := mergedTags.Pictures
-		mergedTags = &MP4Tags{}
+		mergedChapters := mergedTags.Chapters
+		mergedTags = &MP4Tags{ItunesStik: ItunesStikNone}
 		mergedTags.Pictures = mergedPics
+		mergedTags.Chapters = mergedChapters
 	} else if containsStr(delStrings, "allcustom") {
 		mergedTags.Custom = map[string]string{}
 	}
@@ -31,6 +37,13 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.OtherCustom = map[string][]string{}
 	}
 
+	for k := range mergedTags.Custom {
+		if containsStr(delStrings, "custom:"+strings.ToLower(k)) {
+			delete(mergedTags.Custom, k)
+			delete(mergedTags.OtherCustom, k)
+		}
+	}
+
 	if containsStr(delStrings, "album") {
 		mergedTags.Album = ""
 	}
@@ -59,6 +72,18 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.BPM = 0
 	}
 
+	if containsStr(delStrings, "category") {
+		mergedTags.Category = ""
+	}
+
+	if containsStr(delStrings, "chapters") {
+		mergedTags.Chapters = nil
+	}
+
+	if containsStr(delStrings, "compilation") {
+		mergedTags.Compilation = false
+	}
+
 	if containsStr(delStrings, "comment") {
 		mergedTags.Comment = ""
 	}
@@ -91,6 +116,10 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.Description = ""
 	}
 
+	if containsStr(delStrings, "encodingtool") {
+		mergedTags.EncodingTool = ""
+	}
+
 	if containsStr(delStrings, "director") {
 		mergedTags.Director = ""
 	}
@@ -103,10 +132,34 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.DiscTotal = 0
 	}
 
+	if containsStr(delStrings, "episodeguid") {
+		mergedTags.EpisodeGUID = ""
+	}
+
+	if containsStr(delStrings, "gapless") {
+		mergedTags.Gapless = false
+	}
+
 	if containsStr(delStrings, "genre") {
 		mergedTags.Genre = GenreNone
 	}
 
+	if containsStr(delStrings, "grouping") {
+		mergedTags.Grouping = ""
+	}
+
+	if containsStr(delStrings, "hdvideo") {
+		mergedTags.HDVideo = false
+	}
+
+	if containsStr(delStrings, "itunesaccount") {
+		mergedTags.ItunesAccount = ""
+	}
+
+	if containsStr(delStrings, "itunesaccountkind") {
+		mergedTags.ItunesAccountKind = ItunesAccountKindNone
+	}
+
 	if containsStr(delStrings, "itunesadvisory") {
 		mergedTags.ItunesAdvisory = ItunesAdvisoryNone
 	}
@@ -119,18 +172,78 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.ItunesArtistID = 0
 	}
 
+	if containsStr(delStrings, "itunescatalogid") {
+		mergedTags.ItunesCatalogID = 0
+	}
+
+	if containsStr(delStrings, "itunescomposerid") {
+		mergedTags.ItunesComposerID = 0
+	}
+
+	if containsStr(delStrings, "itunesgenreid") {
+		mergedTags.ItunesGenreID = 0
+	}
+
+	if containsStr(delStrings, "itunesowner") {
+		mergedTags.ItunesOwner = ""
+	}
+
+	if containsStr(delStrings, "itunesstik") {
+		mergedTags.ItunesStik = ItunesStikNone
+	}
+
+	if containsStr(delStrings, "itunesstorefrontid") {
+		mergedTags.ItunesStorefrontID = 0
+	}
+
+	if containsStr(delStrings, "keywords") {
+		mergedTags.Keywords = ""
+	}
+
+	if containsStr(delStrings, "longdescription") {
+		mergedTags.LongDescription = ""
+	}
+
 	if containsStr(delStrings, "lyrics") {
 		mergedTags.Lyrics = ""
 	}
 
+	if containsStr(delStrings, "movementcount") {
+		mergedTags.MovementCount = 0
+	}
+
+	if containsStr(delStrings, "movementname") {
+		mergedTags.MovementName = ""
+	}
+
+	if containsStr(delStrings, "movementnumber") {
+		mergedTags.MovementNumber = 0
+	}
+
 	if containsStr(delStrings, "narrator") {
 		mergedTags.Narrator = ""
 	}
 
+	if containsStr(delStrings, "podcast") {
+		mergedTags.Podcast = false
+	}
+
+	if containsStr(delStrings, "podcasturl") {
+		mergedTags.PodcastURL = ""
+	}
+
 	if containsStr(delStrings, "publisher") {
 		mergedTags.Publisher = ""
 	}
 
+	if containsStr(delStrings, "purchasedate") {
+		mergedTags.PurchaseDate = ""
+	}
+
+	if containsStr(delStrings, "showmovement") {
+		mergedTags.ShowMovement = false
+	}
+
 	if containsStr(delStrings, "title") {
 		mergedTags.Title = ""
 	}
@@ -147,10 +260,38 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.TrackTotal = 0
 	}
 
+	if containsStr(delStrings, "tvepisode") {
+		mergedTags.TVEpisode = ""
+	}
+
+	if containsStr(delStrings, "tvepisodenum") {
+		mergedTags.TVEpisodeNum = 0
+	}
+
+	if containsStr(delStrings, "tvnetwork") {
+		mergedTags.TVNetwork = ""
+	}
+
+	if containsStr(delStrings, "tvseason") {
+		mergedTags.TVSeason = 0
+	}
+
+	if containsStr(delStrings, "tvshow") {
+		mergedTags.TVShow = ""
+	}
+
+	if containsStr(delStrings, "work") {
+		mergedTags.Work = ""
+	}
+
 	if containsStr(delStrings, "year") {
 		mergedTags.Year = 0
 	}
 
+	if containsStr(delStrings, "allitems") {
+		mergedTags.RawItems = nil
+	}
+
 	if containsStr(delStrings, "allpictures") {
 		mergedTags.Pictures = []*MP4Picture{}
 	}
@@ -183,10 +324,22 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.BPM = tags.BPM
 	}
 
+	if tags.Category != "" {
+		mergedTags.Category = tags.Category
+	}
+
+	if len(tags.Chapters) > 0 {
+		mergedTags.Chapters = tags.Chapters
+	}
+
 	if tags.Comment != "" {
 		mergedTags.Comment = tags.Comment
 	}
 
+	if tags.Compilation {
+		mergedTags.Compilation = true
+	}
+
 	if tags.Composer != "" {
 		mergedTags.Composer = tags.Composer
 	}
@@ -218,6 +371,10 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.Director = tags.Director
 	}
 
+	if tags.EncodingTool != "" {
+		mergedTags.EncodingTool = tags.EncodingTool
+	}
+
 	if tags.DiscNumber > 0 {
 		mergedTags.DiscNumber = tags.DiscNumber
 	}
@@ -226,6 +383,30 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.DiscTotal = tags.DiscTotal
 	}
 
+	if tags.EpisodeGUID != "" {
+		mergedTags.EpisodeGUID = tags.EpisodeGUID
+	}
+
+	if tags.Gapless {
+		mergedTags.Gapless = true
+	}
+
+	if tags.Grouping != "" {
+		mergedTags.Grouping = tags.Grouping
+	}
+
+	if tags.HDVideo {
+		mergedTags.HDVideo = true
+	}
+
+	if tags.ItunesAccount != "" {
+		mergedTags.ItunesAccount = tags.ItunesAccount
+	}
+
+	if tags.ItunesAccountKind != ItunesAccountKindNone {
+		mergedTags.ItunesAccountKind = tags.ItunesAccountKind
+	}
+
 	if tags.ItunesAdvisory != ItunesAdvisoryNone {
 		mergedTags.ItunesAdvisory = tags.ItunesAdvisory
 	}
@@ -238,18 +419,79 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.ItunesArtistID = tags.ItunesArtistID
 	}
 
+	if tags.ItunesCatalogID > 0 {
+		mergedTags.ItunesCatalogID = tags.ItunesCatalogID
+	}
+
+	if tags.ItunesComposerID > 0 {
+		mergedTags.ItunesComposerID = tags.ItunesComposerID
+	}
+
+	if tags.ItunesGenreID > 0 {
+		mergedTags.ItunesGenreID = tags.ItunesGenreID
+	}
+
+	if tags.ItunesOwner != "" {
+		mergedTags.ItunesOwner = tags.ItunesOwner
+	}
+
+	// HomeVideo is the zero value, so it's only written if ItunesStikSet is.
+	if tags.ItunesStik > HomeVideo || (tags.ItunesStikSet && tags.ItunesStik == HomeVideo) {
+		mergedTags.ItunesStik = tags.ItunesStik
+	}
+
+	if tags.ItunesStorefrontID > 0 {
+		mergedTags.ItunesStorefrontID = tags.ItunesStorefrontID
+	}
+
+	if tags.Keywords != "" {
+		mergedTags.Keywords = tags.Keywords
+	}
+
+	if tags.LongDescription != "" {
+		mergedTags.LongDescription = tags.LongDescription
+	}
+
 	if tags.Lyrics != "" {
 		mergedTags.Lyrics = tags.Lyrics
 	}
 
+	if tags.MovementCount > 0 {
+		mergedTags.MovementCount = tags.MovementCount
+	}
+
+	if tags.MovementName != "" {
+		mergedTags.MovementName = tags.MovementName
+	}
+
+	if tags.MovementNumber > 0 {
+		mergedTags.MovementNumber = tags.MovementNumber
+	}
+
 	if tags.Narrator != "" {
 		mergedTags.Narrator = tags.Narrator
 	}
 
+	if tags.Podcast {
+		mergedTags.Podcast = true
+	}
+
+	if tags.PodcastURL != "" {
+		mergedTags.PodcastURL = tags.PodcastURL
+	}
+
 	if tags.Publisher != "" {
 		mergedTags.Publisher = tags.Publisher
 	}
 
+	if tags.PurchaseDate != "" {
+		mergedTags.PurchaseDate = tags.PurchaseDate
+	}
+
+	if tags.ShowMovement {
+		mergedTags.ShowMovement = true
+	}
+
 	if tags.Title != "" {
 		mergedTags.Title = tags.Title
 	}
@@ -266,6 +508,30 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 		mergedTags.TrackTotal = tags.TrackTotal
 	}
 
+	if tags.TVEpisode != "" {
+		mergedTags.TVEpisode = tags.TVEpisode
+	}
+
+	if tags.TVEpisodeNum > 0 {
+		mergedTags.TVEpisodeNum = tags.TVEpisodeNum
+	}
+
+	if tags.TVNetwork != "" {
+		mergedTags.TVNetwork = tags.TVNetwork
+	}
+
+	if tags.TVSeason > 0 {
+		mergedTags.TVSeason = tags.TVSeason
+	}
+
+	if tags.TVShow != "" {
+		mergedTags.TVShow = tags.TVShow
+	}
+
+	if tags.Work != "" {
+		mergedTags.Work = tags.Work
+	}
+
 	if tags.Year > 0 {
 		mergedTags.Year = tags.Year
 	}
@@ -296,6 +562,31 @@ func overwriteTags(mergedTags, tags *MP4Tags, delStrings []string) *MP4Tags {
 
 	}
 
+	// Items passed in replace any with the same name.
+	var filteredItems []*MP4Item
+	for _, item := range mergedTags.RawItems {
+		if containsStr(delStrings, "item:"+strings.ToLower(item.Name)) {
+			continue
+		}
+		if hasItem(tags.RawItems, item.Name) {
+			continue
+		}
+		// Unknown rtng and stik codes are kept until the field is set or deleted.
+		if item.Name == "rtng" && (mergedTags.ItunesAdvisory != ItunesAdvisoryNone || containsStr(delStrings, "itunesadvisory")) {
+			continue
+		}
+		if item.Name == "stik" && (mergedTags.ItunesStik != ItunesStikNone || containsStr(delStrings, "itunesstik")) {
+			continue
+		}
+		filteredItems = append(filteredItems, item)
+	}
+	for _, item := range tags.RawItems {
+		if item != nil {
+			filteredItems = append(filteredItems, item)
+		}
+	}
+	mergedTags.RawItems = filteredItems
+
 	var filteredPics []*MP4Picture
 
 	for idx, p := range mergedTags.Pictures {
@@ -325,138 +616,314 @@ func putI32BE(n int32) []byte {
 	return buf
 }
 
-func (mp4 MP4) updateChunkOffsets(outF *os.File, boxes MP4Boxes, oldIlistSize, newIlistSize int64) error {
-	stco := boxes.getBoxByPath("moov.trak.mdia.minf.stbl.stco")
-	_, err := mp4.f.Seek(stco.StartOffset+12, io.SeekStart)
-	if err != nil {
-		return err
+func putI64BE(n int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(n))
+	return buf
+}
+
+// Where a source offset ends up once changes are applied.
+func shiftOffset(changes []*patch, offset int64) int64 {
+	shifted := offset
+	for _, c := range changes {
+		if c.end <= offset {
+			shifted += int64(len(c.data)) - (c.end - c.start)
+		}
+	}
+	return shifted
+}
+
+// Moves every chunk offset along with the data it points to. co64 tables
+// hold 64-bit entries, stco tables 32-bit ones.
+func (mp4 MP4) updateChunkOffsetBox(box *MP4Box, changes []*patch) (*patch, error) {
+	var entrySize int64 = 4
+	if strings.HasSuffix(box.Path, "co64") {
+		entrySize = 8
 	}
-	_, err = outF.Seek(stco.StartOffset+16, io.SeekStart)
+	_, err := mp4.r.Seek(box.StartOffset+12, io.SeekStart)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	count, err := mp4.readI32BE()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if stco.BoxSize != int64(count)*4+16 {
-		return &ErrInvalidStcoSize{}
+	if box.BoxSize != int64(uint32(count))*entrySize+16 {
+		return nil, &ErrInvalidStcoSize{}
+	}
+	buf := make([]byte, box.BoxSize-16)
+	_, err = io.ReadFull(mp4.r, buf)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := int32(1); i <= count; i++ {
-		offset, err := mp4.readI32BE()
-		if err != nil {
-			return err
+	for i := 0; i < len(buf); i += int(entrySize) {
+		if entrySize == 8 {
+			offset := int64(binary.BigEndian.Uint64(buf[i:]))
+			binary.BigEndian.PutUint64(buf[i:], uint64(shiftOffset(changes, offset)))
+			continue
 		}
-		offsetBytes := putI32BE(offset - int32(oldIlistSize) + int32(newIlistSize))
-		_, err = outF.Write(offsetBytes)
-		if err != nil {
-			return err
+		offset := shiftOffset(changes, int64(binary.BigEndian.Uint32(buf[i:])))
+		if offset > math.MaxUint32 {
+			return nil, &ErrOffsetOverflow{}
 		}
+		binary.BigEndian.PutUint32(buf[i:], uint32(offset))
 	}
 
-	return nil
+	p := &patch{
+		start: box.StartOffset + 16,
+		end:   box.EndOffset,
+		data:  buf,
+	}
+	return p, nil
+}
+
+func overlapsChange(changes []*patch, box *MP4Box) bool {
+	for _, c := range changes {
+		if box.StartOffset < c.end && c.start < box.EndOffset {
+			return true
+		}
+	}
+	return false
 }
 
-func (mp4 MP4) readToOffset(f *os.File, startOffset int64) error {
-	_, err := mp4.f.Seek(0, io.SeekStart)
+// Moves a track fragment's base data offset if it has one. Without it,
+// offsets are relative to the moof and move with it.
+func (mp4 MP4) updateTfhdBox(box *MP4Box, changes []*patch) (*patch, error) {
+	start := box.StartOffset + box.HeaderSize
+	if box.EndOffset-start < 16 {
+		return nil, nil
+	}
+	_, err := mp4.r.Seek(start, io.SeekStart)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	buf := make([]byte, BufSize)
-	var totalRead int64
+	flags, err := mp4.readI32BE()
+	if err != nil {
+		return nil, err
+	}
+	if flags&0x1 == 0 {
+		return nil, nil
+	}
+	_, err = mp4.r.Seek(4, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := mp4.readI64BE()
+	if err != nil {
+		return nil, err
+	}
+	p := &patch{
+		start: start + 8,
+		end:   start + 16,
+		data:  putI64BE(shiftOffset(changes, offset)),
+	}
+	return p, nil
+}
 
-	for {
-		read, err := mp4.f.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// Moves every moof offset in a track fragment random access table. Entries
+// are 64-bit in version 1 and 32-bit in version 0.
+func (mp4 MP4) updateTfraBox(box *MP4Box, changes []*patch) (*patch, error) {
+	start := box.StartOffset + box.HeaderSize
+	_, err := mp4.r.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, box.EndOffset-start)
+	_, err = io.ReadFull(mp4.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 16 {
+		return nil, &ErrInvalidTfraSize{}
+	}
+	var offsetSize int64 = 4
+	if buf[0] == 1 {
+		offsetSize = 8
+	}
+	sizes := binary.BigEndian.Uint32(buf[8:])
+	numSize := int64(sizes>>4&0x3) + int64(sizes>>2&0x3) + int64(sizes&0x3) + 3
+	entrySize := offsetSize*2 + numSize
+	count := int64(binary.BigEndian.Uint32(buf[12:]))
+	if int64(len(buf)) != count*entrySize+16 {
+		return nil, &ErrInvalidTfraSize{}
+	}
+
+	for i := int64(16); i < int64(len(buf)); i += entrySize {
+		pos := i + offsetSize
+		if offsetSize == 8 {
+			offset := int64(binary.BigEndian.Uint64(buf[pos:]))
+			binary.BigEndian.PutUint64(buf[pos:], uint64(shiftOffset(changes, offset)))
+			continue
+		}
+		offset := shiftOffset(changes, int64(binary.BigEndian.Uint32(buf[pos:])))
+		if offset > math.MaxUint32 {
+			return nil, &ErrOffsetOverflow{}
 		}
-		readI64 := int64(read)
-		totalRead += readI64
-		if totalRead > startOffset {
-			_, err = f.Write(buf[:readI64+startOffset-totalRead])
+		binary.BigEndian.PutUint32(buf[pos:], uint32(offset))
+	}
+
+	p := &patch{
+		start: start + 16,
+		end:   box.EndOffset,
+		data:  buf[16:],
+	}
+	return p, nil
+}
+
+func (mp4 MP4) updateChunkOffsets(boxes MP4Boxes, changes []*patch) ([]*patch, error) {
+	var patches []*patch
+	updaters := []struct {
+		path   string
+		update func(*MP4Box, []*patch) (*patch, error)
+	}{
+		{"moov.trak.mdia.minf.stbl.stco", mp4.updateChunkOffsetBox},
+		{"moov.trak.mdia.minf.stbl.co64", mp4.updateChunkOffsetBox},
+		{"moof.traf.tfhd", mp4.updateTfhdBox},
+		{"mfra.tfra", mp4.updateTfraBox},
+	}
+	for _, updater := range updaters {
+		for _, box := range boxes.getBoxesByPath(updater.path) {
+			// Tables in boxes being replaced are already up to date.
+			if overlapsChange(changes, box) {
+				continue
+			}
+			p, err := updater.update(box, changes)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			break
+			if p != nil {
+				patches = append(patches, p)
+			}
+		}
+	}
+	return patches, nil
+}
+
+func (mp4 MP4) copyRange(w io.Writer, buf []byte, start, end int64) error {
+	_, err := mp4.r.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyBuffer(w, io.LimitReader(mp4.r, end-start), buf)
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func patchDepth(p *patch) int {
+	if p.parent == nil {
+		return 0
+	}
+	return strings.Count(p.parent.Path, ".") + 2
+}
+
+// Sorts patches by position. Insertions at the same offset go innermost
+// first, so a box added at the end of a child comes before one added at the
+// end of its parent, and before anything replaced from that offset.
+func sortPatches(patches []*patch) {
+	sort.SliceStable(patches, func(i, j int) bool {
+		a, b := patches[i], patches[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		aInsert, bInsert := a.start == a.end, b.start == b.end
+		if aInsert != bInsert {
+			return aInsert
+		}
+		return aInsert && patchDepth(a) > patchDepth(b)
+	})
+}
+
+// Streams the source to w with each patch's byte range swapped for its data.
+func (mp4 MP4) writePatched(w io.Writer, patches []*patch) error {
+	sortPatches(patches)
+	buf := make([]byte, BufSize)
+	var pos int64
+	for _, p := range patches {
+		err := mp4.copyRange(w, buf, pos, p.start)
+		if err != nil {
+			return err
 		}
-		_, err = f.Write(buf)
+		_, err = w.Write(p.data)
 		if err != nil {
 			return err
 		}
+		pos = p.end
 	}
-	return nil
+	return mp4.copyRange(w, buf, pos, mp4.size)
 }
 
-func writeRegular(f *os.File, boxName, val string, prefix bool) error {
+func writeRegular(w io.Writer, boxName, val string, prefix bool) error {
 	// boxSize := utf8.RuneCountInString(val) + 24
 	valBytes := []byte(val)
 	boxSize := len(valBytes) + 24
 	boxSizeI32 := int32(boxSize)
 	boxSizeBytes := putI32BE(boxSizeI32)
-	_, err := f.Write(boxSizeBytes)
+	_, err := w.Write(boxSizeBytes)
 	if err != nil {
 		return err
 	}
 	if prefix {
-		_, err = f.Write([]byte{0xA9})
+		_, err = w.Write([]byte{0xA9})
 		if err != nil {
 			return err
 		}
 	}
-	_, err = f.WriteString(boxName)
+	_, err = io.WriteString(w, boxName)
 	if err != nil {
 		return err
 	}
 	boxSizeBytes = putI32BE(boxSizeI32 - 8)
-	_, err = f.Write(boxSizeBytes)
+	_, err = w.Write(boxSizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(
+	_, err = w.Write(
 		[]byte{0x0, 0x0, 0x0, 0x01, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(valBytes)
+	_, err = w.Write(valBytes)
 	return err
 }
 
-func writeGenre(f *os.File, genre Genre) error {
-	_, err := f.Write([]byte{0x0, 0x0, 0x0, 0x1A})
+func writeGenre(w io.Writer, genre Genre) error {
+	_, err := w.Write([]byte{0x0, 0x0, 0x0, 0x1A})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("gnre")
+	_, err = io.WriteString(w, "gnre")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x12})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x12})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(bytes.Repeat([]byte{0x0}, 9))
+	_, err = w.Write(make([]byte, 8))
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{byte(genre)})
+	_, err = w.Write(putI16BE(int16(genre)))
 	return err
 }
 
-func writeTrknDisc(f *os.File, n, total int16, isTrkn bool) error {
+func writeTrknDisc(w io.Writer, n, total int16, isTrkn bool) error {
 	var boxSize int32 = 30
 	if n < 0 {
 		n = 0
@@ -468,14 +935,14 @@ func writeTrknDisc(f *os.File, n, total int16, isTrkn bool) error {
 		boxSize += 2
 	}
 	boxSizeBytes := putI32BE(boxSize)
-	_, err := f.Write(boxSizeBytes)
+	_, err := w.Write(boxSizeBytes)
 	if err != nil {
 		return err
 	}
 	if isTrkn {
-		_, err = f.WriteString("trkn")
+		_, err = io.WriteString(w, "trkn")
 	} else {
-		_, err = f.WriteString("disk")
+		_, err = io.WriteString(w, "disk")
 	}
 	if err != nil {
 		return err
@@ -484,143 +951,173 @@ func writeTrknDisc(f *os.File, n, total int16, isTrkn bool) error {
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(boxSizeBytes)
+	_, err = w.Write(boxSizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(bytes.Repeat([]byte{0x0}, 10))
+	_, err = w.Write(bytes.Repeat([]byte{0x0}, 10))
 	if err != nil {
 		return err
 	}
 
 	nBytes := putI16BE(n)
-	_, err = f.Write(nBytes)
+	_, err = w.Write(nBytes)
 	if err != nil {
 		return err
 	}
 	totalBytes := putI16BE(total)
-	_, err = f.Write(totalBytes)
+	_, err = w.Write(totalBytes)
 	if err != nil {
 		return err
 	}
 	if isTrkn {
-		_, err = f.Write([]byte{0x0, 0x0})
+		_, err = w.Write([]byte{0x0, 0x0})
 		return err
 	}
 	return nil
 }
 
-func writeBPM(f *os.File, bpm int16) error {
-	_, err := f.Write([]byte{0x0, 0x0, 0x0, 0x1A})
+func writeBPM(w io.Writer, bpm int16) error {
+	return writeInt16Atom(w, "tmpo", bpm, false)
+}
+
+func writeInt16Atom(w io.Writer, boxName string, num int16, prefix bool) error {
+	_, err := w.Write([]byte{0x0, 0x0, 0x0, 0x1A})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("tmpo")
+	if prefix {
+		_, err = w.Write([]byte{0xA9})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, boxName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x12})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x12})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(
+	_, err = w.Write(
 		[]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
-	bpmBytes := putI16BE(bpm)
-	_, err = f.Write(bpmBytes)
+	numBytes := putI16BE(num)
+	_, err = w.Write(numBytes)
 	return err
 }
 
-func writeAdvisory(f *os.File, advisory ItunesAdvisory) error {
-	_, err := f.Write([]byte{0x0, 0x0, 0x0, 0x19})
+func writeAdvisory(w io.Writer, advisory ItunesAdvisory) error {
+	_, err := w.Write([]byte{0x0, 0x0, 0x0, 0x19})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("rtng")
+	_, err = io.WriteString(w, "rtng")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x11})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x11})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{byte(advisory)})
+	_, err = w.Write([]byte{byte(advisory)})
 	return err
 }
 
-func writeItunesAlbumID(f *os.File, albumID int32) error {
-	_, err := f.Write([]byte{0x0, 0x0, 0x0, 0x20})
+// Writes a one byte int atom, like stik or the flags.
+func writeByteAtom(w io.Writer, boxName string, b byte) error {
+	_, err := w.Write([]byte{0x0, 0x0, 0x0, 0x19})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("plID")
+	_, err = io.WriteString(w, boxName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x18})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x11})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(
-		[]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
-	albumIDBytes := putI32BE(albumID)
-	_, err = f.Write(albumIDBytes)
+	_, err = w.Write([]byte{b})
 	return err
 }
 
-func writeItunesArtistID(f *os.File, artistID int32) error {
-	_, err := f.Write([]byte{0x0, 0x0, 0x0, 0x1C})
+// Writes an unsigned int atom size bytes wide, or 8 if num doesn't fit.
+func writeUnsignedIntAtom(w io.Writer, boxName string, num int64, size int) error {
+	if size < 8 && num >= 1<<(size*8-1) && num < 1<<(size*8) {
+		num -= 1 << (size * 8)
+	}
+	return writeIntAtom(w, boxName, num, size)
+}
+
+// Writes a signed int atom size bytes wide, or 8 if num doesn't fit.
+func writeIntAtom(w io.Writer, boxName string, num int64, size int) error {
+	if size < 8 && (num < -1<<(size*8-1) || num >= 1<<(size*8-1)) {
+		size = 8
+	}
+	numBytes := putI64BE(num)[8-size:]
+	_, err := w.Write(putI32BE(int32(size + 24)))
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("atID")
+	_, err = io.WriteString(w, boxName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x14})
+	_, err = w.Write(putI32BE(int32(size + 16)))
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(
+	_, err = w.Write(
 		[]byte{0x0, 0x0, 0x0, 0x15, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
-	artistIDBytes := putI32BE(artistID)
-	_, err = f.Write(artistIDBytes)
+	_, err = w.Write(numBytes)
 	return err
 }
 
-func writeCustom(f *os.File, name, value string, upper bool, others map[string][]string) error {
+// plID is always 64-bit.
+func writeItunesAlbumID(w io.Writer, albumID int64) error {
+	return writeIntAtom(w, "plID", albumID, 8)
+}
+
+func writeItunesArtistID(w io.Writer, artistID int32) error {
+	return writeIntAtom(w, "atID", int64(artistID), 4)
+}
+
+func writeCustom(w io.Writer, name, value string, upper bool, others map[string][]string) error {
 	valueBytes := []byte(value)
 	valueSize := len(valueBytes)
 
@@ -639,62 +1136,62 @@ func writeCustom(f *os.File, name, value string, upper bool, others map[string][
 
 	// 48
 	sizeBytes := putI32BE(int32(totalSize))
-	_, err := f.Write(sizeBytes)
+	_, err := w.Write(sizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("----")
+	_, err = io.WriteString(w, "----")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write([]byte{0x0, 0x0, 0x0, 0x1C})
+	_, err = w.Write([]byte{0x0, 0x0, 0x0, 0x1C})
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("mean")
+	_, err = io.WriteString(w, "mean")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(bytes.Repeat([]byte{0x0}, 4))
+	_, err = w.Write(bytes.Repeat([]byte{0x0}, 4))
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("com.apple.iTunes")
+	_, err = io.WriteString(w, itunesMean)
 	if err != nil {
 		return err
 	}
 	sizeBytes = putI32BE(int32(nameSize) + 12)
-	_, err = f.Write(sizeBytes)
+	_, err = w.Write(sizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("name")
+	_, err = io.WriteString(w, "name")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(bytes.Repeat([]byte{0x0}, 4))
+	_, err = w.Write(bytes.Repeat([]byte{0x0}, 4))
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(nameUpperBytes)
+	_, err = w.Write(nameUpperBytes)
 	if err != nil {
 		return err
 	}
 	sizeBytes = putI32BE(int32(valueSize) + 16)
-	_, err = f.Write(sizeBytes)
+	_, err = w.Write(sizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("data")
+	_, err = io.WriteString(w, "data")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(
+	_, err = w.Write(
 		[]byte{0x0, 0x0, 0x0, 0x01, 0x0, 0x0, 0x0, 0x0})
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(valueBytes)
+	_, err = w.Write(valueBytes)
 	if err != nil {
 		return err
 	}
@@ -703,20 +1200,20 @@ func writeCustom(f *os.File, name, value string, upper bool, others map[string][
 		valueBytes = []byte(v)
 		valueSize = len(valueBytes)
 		sizeBytes = putI32BE(int32(valueSize) + 16)
-		_, err = f.Write(sizeBytes)
+		_, err = w.Write(sizeBytes)
 		if err != nil {
 			return err
 		}
-		_, err = f.WriteString("data")
+		_, err = io.WriteString(w, "data")
 		if err != nil {
 			return err
 		}
-		_, err = f.Write(
+		_, err = w.Write(
 			[]byte{0x0, 0x0, 0x0, 0x01, 0x0, 0x0, 0x0, 0x0})
 		if err != nil {
 			return err
 		}
-		_, err = f.Write(valueBytes)
+		_, err = w.Write(valueBytes)
 		if err != nil {
 			return err
 		}
@@ -730,14 +1227,20 @@ func getPicFormat(imageType ImageType, magic []byte) uint8 {
 		if bytes.Equal(magic, []byte{0x89, 0x50, 0x4E, 0x47}) {
 			return 0xE
 		}
+		if bytes.HasPrefix(magic, []byte("BM")) {
+			return 0x1B
+		}
 	}
 	if imageType == ImageTypePNG {
 		return 0xE
 	}
+	if imageType == ImageTypeBMP {
+		return 0x1B
+	}
 	return 0x0D
 }
 
-func writePics(f *os.File, pics []*MP4Picture) error {
+func writePics(w io.Writer, pics []*MP4Picture) error {
 	var boxSize int32 = 8
 	for _, pic := range pics {
 		dataSize := len(pic.Data)
@@ -748,11 +1251,11 @@ func writePics(f *os.File, pics []*MP4Picture) error {
 	}
 
 	boxSizeBytes := putI32BE(boxSize)
-	_, err := f.Write(boxSizeBytes)
+	_, err := w.Write(boxSizeBytes)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("covr")
+	_, err = io.WriteString(w, "covr")
 	if err != nil {
 		return err
 	}
@@ -763,21 +1266,21 @@ func writePics(f *os.File, pics []*MP4Picture) error {
 			continue
 		}
 		boxSizeBytes = putI32BE(int32(dataSize + 16))
-		_, err = f.Write(boxSizeBytes)
+		_, err = w.Write(boxSizeBytes)
 		if err != nil {
 			return err
 		}
-		_, err = f.WriteString("data")
+		_, err = io.WriteString(w, "data")
 		if err != nil {
 			return err
 		}
 
 		format := getPicFormat(pic.Format, pic.Data[:4])
-		_, err = f.Write([]byte{0x0, 0x0, 0x0, format, 0x0, 0x0, 0x0, 0x0})
+		_, err = w.Write([]byte{0x0, 0x0, 0x0, format, 0x0, 0x0, 0x0, 0x0})
 		if err != nil {
 			return err
 		}
-		_, err = f.Write(pic.Data)
+		_, err = w.Write(pic.Data)
 		if err != nil {
 			return err
 		}
@@ -786,350 +1289,844 @@ func writePics(f *os.File, pics []*MP4Picture) error {
 	return nil
 }
 
-func resizeBoxes(f *os.File, boxes MP4Boxes, oldIlstSize, newIlistSize int64) error {
-	moov := boxes.getBoxByPath("moov")
-	udta := boxes.getBoxByPath("moov.udta")
-	meta := boxes.getBoxByPath("moov.udta.meta")
-
-	sizeBytes := putI32BE(int32(newIlistSize))
-	_, err := f.Write(sizeBytes)
-	if err != nil {
-		return err
+// Rewrites a box's size field, keeping 64-bit sizes 64-bit.
+func resizeBox(box *MP4Box, newSize int64) (*patch, error) {
+	if box.HeaderSize == 16 {
+		p := &patch{
+			start: box.StartOffset + 8,
+			end:   box.StartOffset + 16,
+			data:  putI64BE(newSize),
+		}
+		return p, nil
 	}
-
-	_, err = f.Seek(moov.StartOffset, io.SeekStart)
-	if err != nil {
-		return err
+	if newSize > math.MaxUint32 {
+		return nil, &ErrBoxTooLarge{}
 	}
-	newMoovSize := moov.BoxSize - oldIlstSize + newIlistSize
-	sizeBytes = putI32BE(int32(newMoovSize))
-	_, err = f.Write(sizeBytes)
-	if err != nil {
-		return err
+	p := &patch{
+		start: box.StartOffset,
+		end:   box.StartOffset + 4,
+		data:  putI32BE(int32(newSize)),
 	}
+	return p, nil
+}
 
-	_, err = f.Seek(udta.StartOffset, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	newUdtaSize := udta.BoxSize - oldIlstSize + newIlistSize
-	sizeBytes = putI32BE(int32(newUdtaSize))
-	_, err = f.Write(sizeBytes)
-	if err != nil {
-		return err
+// The box and every box it's nested in.
+func (boxes MP4Boxes) getAncestors(box *MP4Box) []*MP4Box {
+	var ancestors []*MP4Box
+	for _, b := range boxes.Boxes {
+		if b.StartOffset > box.StartOffset || b.EndOffset < box.EndOffset {
+			continue
+		}
+		if b.Path == box.Path || strings.HasPrefix(box.Path, b.Path+".") {
+			ancestors = append(ancestors, b)
+		}
 	}
+	return ancestors
+}
 
-	_, err = f.Seek(meta.StartOffset, io.SeekStart)
-	if err != nil {
-		return err
+// The box that box is nested in, or nil at the top level.
+func (boxes MP4Boxes) getParent(box *MP4Box) *MP4Box {
+	idx := strings.LastIndex(box.Path, ".")
+	if idx == -1 {
+		return nil
 	}
-	newMetaSize := meta.BoxSize - oldIlstSize + newIlistSize
-	sizeBytes = putI32BE(int32(newMetaSize))
-	_, err = f.Write(sizeBytes)
-	return err
+	for _, b := range boxes.getAncestors(box) {
+		if b.Path == box.Path[:idx] {
+			return b
+		}
+	}
+	return nil
 }
 
-func (mp4 MP4) writeRemaining(f *os.File) error {
-	buf := make([]byte, BufSize)
-	for {
-		read, err := mp4.f.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// Resizes every box that holds a change.
+func resizeParents(boxes MP4Boxes, changes []*patch) ([]*patch, error) {
+	var (
+		patches []*patch
+		resized []*MP4Box
+	)
+	deltas := map[*MP4Box]int64{}
+	for _, c := range changes {
+		if c.parent == nil {
+			continue
 		}
-		if read < BufSize {
-			_, err := f.Write(buf[:read])
-			if err != nil {
-				return err
-			}
-		} else {
-			_, err = f.Write(buf)
-			if err != nil {
-				return err
+		delta := int64(len(c.data)) - (c.end - c.start)
+		for _, box := range boxes.getAncestors(c.parent) {
+			_, ok := deltas[box]
+			if !ok {
+				resized = append(resized, box)
 			}
+			deltas[box] += delta
 		}
 	}
-	return nil
+	for _, box := range resized {
+		if box.ToEOF || deltas[box] == 0 {
+			continue
+		}
+		p, err := resizeBox(box, box.BoxSize+deltas[box])
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, p)
+	}
+	return patches, nil
 }
 
-func (mp4 MP4) writeTags(boxes MP4Boxes, tags *MP4Tags, tempPath string) error {
-	ilst := boxes.getBoxByPath("moov.udta.meta.ilst")
-	oldIlstSize := ilst.BoxSize
-	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY, 0o644)
+// Turns changes into patches, along with the patches for every box size and
+// chunk offset they affect.
+func (mp4 MP4) applyChanges(boxes MP4Boxes, changes []*patch) ([]*patch, error) {
+	patches, err := resizeParents(boxes, changes)
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-	err = mp4.readToOffset(f, ilst.StartOffset)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	ilstStartOffset, err := getPos(f)
+	offsetPatches, err := mp4.updateChunkOffsets(boxes, changes)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	patches = append(patches, offsetPatches...)
+	return append(patches, changes...), nil
+}
 
-	_, err = f.Write(bytes.Repeat([]byte{0x0}, 4))
-	if err != nil {
-		return err
+func makeBox(boxName string, payload []byte) []byte {
+	box := putI32BE(int32(len(payload) + 8))
+	box = append(box, boxName...)
+	return append(box, payload...)
+}
+
+// Wraps a new ilst in whichever of udta, meta and hdlr the file is missing.
+// udtaExtra is added alongside meta if udta has to be made.
+func wrapIlst(boxes MP4Boxes, newIlst, udtaExtra []byte) []byte {
+	if boxes.getBoxByPath("moov.udta.meta") != nil {
+		return newIlst
+	}
+	hdlr := []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
+	hdlr = append(hdlr, "mdirappl"...)
+	hdlr = append(hdlr, bytes.Repeat([]byte{0x0}, 9)...)
+	metaPayload := bytes.Repeat([]byte{0x0}, 4)
+	metaPayload = append(metaPayload, makeBox("hdlr", hdlr)...)
+	metaPayload = append(metaPayload, newIlst...)
+	meta := makeBox("meta", metaPayload)
+	if boxes.getBoxByPath("moov.udta") != nil {
+		return meta
+	}
+	return makeBox("udta", append(meta, udtaExtra...))
+}
+
+// Where the new ilst goes; the end of its deepest existing parent if absent.
+// Also returns the box that grows with it.
+func getIlstRange(boxes MP4Boxes) (int64, int64, *MP4Box) {
+	ilst := boxes.getBoxByPath("moov.udta.meta.ilst")
+	if ilst != nil {
+		return ilst.StartOffset, ilst.EndOffset, boxes.getBoxByPath("moov.udta.meta")
 	}
-	_, err = f.WriteString("ilst")
-	if err != nil {
-		return err
+	for _, path := range []string{"moov.udta.meta", "moov.udta", "moov"} {
+		box := boxes.getBoxByPath(path)
+		if box != nil {
+			return box.childrenEnd(), box.childrenEnd(), box
+		}
 	}
+	return -1, -1, nil
+}
+
+func (mp4 MP4) writeTags(buf *bytes.Buffer, tags *MP4Tags) error {
+	buf.Write(bytes.Repeat([]byte{0x0}, 4))
+	buf.WriteString("ilst")
+	var err error
 	if tags.Title != "" {
-		err = writeRegular(f, "nam", tags.Title, true)
+		err = writeRegular(buf, "nam", tags.Title, true)
 		if err != nil {
 			return err
 		}
 	}
 	if tags.TitleSort != "" {
-		err = writeRegular(f, "sonm", tags.TitleSort, false)
+		err = writeRegular(buf, "sonm", tags.TitleSort, false)
 		if err != nil {
 			return err
 		}
 	}
 	if tags.Album != "" {
-		err = writeRegular(f, "alb", tags.Album, true)
+		err = writeRegular(buf, "alb", tags.Album, true)
 		if err != nil {
 			return err
 		}
 	}
 	if tags.AlbumSort != "" {
-		err = writeRegular(f, "soal", tags.AlbumSort, false)
+		err = writeRegular(buf, "soal", tags.AlbumSort, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.AlbumArtist != "" {
-		err = writeRegular(f, "aART", tags.AlbumArtist, false)
+		err = writeRegular(buf, "aART", tags.AlbumArtist, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.AlbumArtistSort != "" {
-		err = writeRegular(f, "soaa", tags.AlbumArtistSort, false)
+		err = writeRegular(buf, "soaa", tags.AlbumArtistSort, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Artist != "" {
-		err = writeRegular(f, "ART", tags.Artist, true)
+		err = writeRegular(buf, "ART", tags.Artist, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.ArtistSort != "" {
-		err = writeRegular(f, "soar", tags.ArtistSort, false)
+		err = writeRegular(buf, "soar", tags.ArtistSort, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Comment != "" {
-		err = writeRegular(f, "cmt", tags.Comment, true)
+		err = writeRegular(buf, "cmt", tags.Comment, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Composer != "" {
-		err = writeRegular(f, "wrt", tags.Composer, true)
+		err = writeRegular(buf, "wrt", tags.Composer, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.ComposerSort != "" {
-		err = writeRegular(f, "soco", tags.ComposerSort, false)
+		err = writeRegular(buf, "soco", tags.ComposerSort, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Copyright != "" {
-		err = writeRegular(f, "cprt", tags.Copyright, false)
+		err = writeRegular(buf, "cprt", tags.Copyright, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Lyrics != "" {
-		err = writeRegular(f, "lyr", tags.Lyrics, true)
+		err = writeRegular(buf, "lyr", tags.Lyrics, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.CustomGenre != "" {
-		err = writeRegular(f, "gen", tags.CustomGenre, true)
+		err = writeRegular(buf, "gen", tags.CustomGenre, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Description != "" {
-		err = writeRegular(f, "desc", tags.Description, false)
+		err = writeRegular(buf, "desc", tags.Description, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Publisher != "" {
-		err = writeRegular(f, "pub", tags.Publisher, true)
+		err = writeRegular(buf, "pub", tags.Publisher, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Conductor != "" {
-		err = writeRegular(f, "con", tags.Conductor, true)
+		err = writeRegular(buf, "con", tags.Conductor, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Director != "" {
+		err = writeRegular(buf, "dir", tags.Director, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Work != "" {
+		err = writeRegular(buf, "wrk", tags.Work, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.MovementName != "" {
+		err = writeRegular(buf, "mvn", tags.MovementName, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.MovementNumber > 0 {
+		err = writeInt16Atom(buf, "mvi", tags.MovementNumber, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.MovementCount > 0 {
+		err = writeInt16Atom(buf, "mvc", tags.MovementCount, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Narrator != "" {
+		err = writeRegular(buf, "nrt", tags.Narrator, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.EncodingTool != "" {
+		err = writeRegular(buf, "too", tags.EncodingTool, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.LongDescription != "" {
+		err = writeRegular(buf, "ldes", tags.LongDescription, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.TVShow != "" {
+		err = writeRegular(buf, "tvsh", tags.TVShow, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.TVNetwork != "" {
+		err = writeRegular(buf, "tvnn", tags.TVNetwork, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.TVEpisode != "" {
+		err = writeRegular(buf, "tven", tags.TVEpisode, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.TVSeason > 0 {
+		err = writeIntAtom(buf, "tvsn", int64(tags.TVSeason), 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.TVEpisodeNum > 0 {
+		err = writeIntAtom(buf, "tves", int64(tags.TVEpisodeNum), 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Compilation {
+		err = writeByteAtom(buf, "cpil", 0x01)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Gapless {
+		err = writeByteAtom(buf, "pgap", 0x01)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.HDVideo {
+		err = writeByteAtom(buf, "hdvd", 0x01)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ShowMovement {
+		err = writeByteAtom(buf, "shwm", 0x01)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Grouping != "" {
+		err = writeRegular(buf, "grp", tags.Grouping, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Keywords != "" {
+		err = writeRegular(buf, "keyw", tags.Keywords, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Category != "" {
+		err = writeRegular(buf, "catg", tags.Category, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.PodcastURL != "" {
+		err = writeRegular(buf, "purl", tags.PodcastURL, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.EpisodeGUID != "" {
+		err = writeRegular(buf, "egid", tags.EpisodeGUID, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.PurchaseDate != "" {
+		err = writeRegular(buf, "purd", tags.PurchaseDate, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.Podcast {
+		err = writeByteAtom(buf, "pcst", 0x01)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesStik != ItunesStikNone {
+		err = writeByteAtom(buf, "stik", uint8(tags.ItunesStik))
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.ItunesAdvisory != ItunesAdvisoryNone {
-		err = writeAdvisory(f, tags.ItunesAdvisory)
+		err = writeAdvisory(buf, tags.ItunesAdvisory)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.ItunesAlbumID > 0 {
-		err = writeItunesAlbumID(f, tags.ItunesAlbumID)
+		err = writeItunesAlbumID(buf, tags.ItunesAlbumID)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.ItunesArtistID > 0 {
-		err = writeItunesArtistID(f, tags.ItunesArtistID)
+		err = writeItunesArtistID(buf, tags.ItunesArtistID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesCatalogID > 0 {
+		err = writeUnsignedIntAtom(buf, "cnID", tags.ItunesCatalogID, 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesGenreID > 0 {
+		err = writeIntAtom(buf, "geID", int64(tags.ItunesGenreID), 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesStorefrontID > 0 {
+		err = writeIntAtom(buf, "sfID", int64(tags.ItunesStorefrontID), 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesComposerID > 0 {
+		err = writeUnsignedIntAtom(buf, "cmID", tags.ItunesComposerID, 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesAccount != "" {
+		err = writeRegular(buf, "apID", tags.ItunesAccount, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesOwner != "" {
+		err = writeRegular(buf, "ownr", tags.ItunesOwner, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags.ItunesAccountKind != ItunesAccountKindNone {
+		err = writeByteAtom(buf, "akID", itunesAccountKindCodes[tags.ItunesAccountKind])
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.TrackNumber > 0 || tags.TrackTotal > 0 {
-		err = writeTrknDisc(f, tags.TrackNumber, tags.TrackTotal, true)
+		err = writeTrknDisc(buf, tags.TrackNumber, tags.TrackTotal, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.DiscNumber > 0 || tags.DiscTotal > 0 {
-		err = writeTrknDisc(f, tags.DiscNumber, tags.DiscTotal, false)
+		err = writeTrknDisc(buf, tags.DiscNumber, tags.DiscTotal, false)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.BPM > 0 {
-		err = writeBPM(f, tags.BPM)
+		err = writeBPM(buf, tags.BPM)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Year > 0 {
-		err = writeRegular(f, "day", strconv.Itoa(int(tags.Year)), true)
+		err = writeRegular(buf, "day", strconv.Itoa(int(tags.Year)), true)
 		if err != nil {
 			return err
 		}
-	} else if tags.Date == "" {
-		err = writeRegular(f, "day", tags.Date, true)
+	} else if tags.Date != "" {
+		err = writeRegular(buf, "day", tags.Date, true)
 		if err != nil {
 			return err
 		}
 	}
 
 	if tags.Genre != GenreNone {
-		err = writeGenre(f, tags.Genre)
+		err = writeGenre(buf, tags.Genre)
 		if err != nil {
 			return err
 		}
 	}
 
 	for k, v := range tags.Custom {
-		err = writeCustom(f, k, v, mp4.upperCustom, tags.OtherCustom)
+		err = writeCustom(buf, k, v, mp4.upperCustom, tags.OtherCustom)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = writePics(f, tags.Pictures)
+	err = writeItems(buf, tags.RawItems)
 	if err != nil {
 		return err
 	}
 
-	newIlstEndOffset, err := getPos(f)
+	if len(tags.Pictures) > 0 {
+		err = writePics(buf, tags.Pictures)
+		if err != nil {
+			return err
+		}
+	}
+
+	copy(buf.Bytes(), putI32BE(int32(buf.Len())))
+	return nil
+}
+
+// Finds a free or skip box straight after ilst or one of its parents. It can
+// absorb a change in ilst's size so that nothing else in the file has to move.
+// Also returns the boxes between ilst and the padding whose sizes change.
+func getPadding(boxes MP4Boxes) (*MP4Box, []*MP4Box) {
+	var resized []*MP4Box
+	paths := []string{"moov.udta.meta.ilst", "moov.udta.meta", "moov.udta", "moov"}
+	for idx, path := range paths {
+		box := boxes.getBoxByPath(path)
+		if box == nil {
+			return nil, nil
+		}
+		if idx > 0 {
+			resized = append(resized, box)
+		}
+		parent := path[:strings.LastIndex(path, ".")+1]
+		for _, pad := range boxes.Boxes {
+			if pad.StartOffset != box.EndOffset || pad.HeaderSize != 8 || pad.ToEOF {
+				continue
+			}
+			if pad.Path == parent+"free" || pad.Path == parent+"skip" {
+				return pad, resized
+			}
+		}
+	}
+	return nil, nil
+}
+
+func makeFree(boxName string, size int64) []byte {
+	return makeBox(boxName, make([]byte, size-8))
+}
+
+// Plans a write that keeps the file the same size by growing or shrinking
+// padding. Returns nil if there isn't enough padding.
+func (mp4 MP4) planInPlace(boxes MP4Boxes, newIlst []byte) ([]*patch, error) {
+	ilst := boxes.getBoxByPath("moov.udta.meta.ilst")
+	if ilst == nil {
+		return nil, nil
+	}
+	delta := int64(len(newIlst)) - ilst.BoxSize
+	if delta == 0 {
+		p := &patch{
+			start: ilst.StartOffset,
+			end:   ilst.EndOffset,
+			data:  newIlst,
+		}
+		return []*patch{p}, nil
+	}
+	pad, resized := getPadding(boxes)
+	if pad == nil {
+		return nil, nil
+	}
+	newPadSize := pad.BoxSize - delta
+	if newPadSize != 0 && newPadSize < 8 {
+		return nil, nil
+	}
+
+	between := make([]byte, pad.StartOffset-ilst.EndOffset)
+	_, err := mp4.r.Seek(ilst.EndOffset, io.SeekStart)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	newIlstSize := newIlstEndOffset - ilstStartOffset
-	_, err = f.Seek(ilstStartOffset, io.SeekStart)
+	_, err = io.ReadFull(mp4.r, between)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	data := append(newIlst, between...)
+	if newPadSize > 0 {
+		data = append(data, makeFree(pad.Path[len(pad.Path)-4:], newPadSize)...)
+	}
+
+	// The pad is a sibling of ilst or of one of the boxes in resized, which
+	// are all that grow by delta. The patch from ilst to the end of the pad
+	// keeps its length, so it has no parent for applyChanges to resize and
+	// must never be passed through it.
+	var patches []*patch
+	for _, box := range resized {
+		if box.ToEOF {
+			continue
+		}
+		p, err := resizeBox(box, box.BoxSize+delta)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, p)
+	}
+	patches = append(patches, &patch{
+		start: ilst.StartOffset,
+		end:   pad.EndOffset,
+		data:  data,
+	})
+	return patches, nil
+}
+
+// Plans a write that moves everything after ilst, reserving mp4.padding
+// bytes of free space after it for later in-place writes.
+func (mp4 MP4) planRewrite(boxes MP4Boxes, newIlst []byte, chapters []*MP4Chapter, writeChapters bool, extra []*patch) ([]*patch, error) {
+	var udtaExtra []byte
+	if writeChapters && len(chapters) > 0 && boxes.getBoxByPath("moov.udta") == nil {
+		udtaExtra = makeChpl(chapters)
+	}
+
+	start, end, parent := getIlstRange(boxes)
+	data := newIlst
+	var changes []*patch
+	if mp4.padding >= 8 {
+		data = append(data, makeFree("free", mp4.padding)...)
+		// Replaces any padding already straight after ilst. Padding outside
+		// meta is deleted on its own so that its parent shrinks instead.
+		ilst := boxes.getBoxByPath("moov.udta.meta.ilst")
+		pad, _ := getPadding(boxes)
+		if ilst != nil && pad != nil && pad.StartOffset == ilst.EndOffset {
+			if boxes.getParent(pad) == parent {
+				end = pad.EndOffset
+			} else {
+				changes = append(changes, &patch{
+					start:  pad.StartOffset,
+					end:    pad.EndOffset,
+					parent: boxes.getParent(pad),
+				})
+			}
+		}
+	}
+	changes = append(changes, &patch{
+		start:  start,
+		end:    end,
+		data:   wrapIlst(boxes, data, udtaExtra),
+		parent: parent,
+	})
+	changes = append(changes, extra...)
+	if writeChapters {
+		var err error
+		changes, err = mp4.planChapters(boxes, chapters, changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mp4.applyChanges(boxes, changes)
+}
+
+func isInPlace(patches []*patch) bool {
+	for _, p := range patches {
+		if int64(len(p.data)) != p.end-p.start {
+			return false
+		}
+	}
+	return true
+}
+
+func (mp4 *MP4) planWrite(tags *MP4Tags, _delStrings []string) ([]*patch, error) {
+	delStrings := strArrToLower(_delStrings)
+
+	mergedTags, boxes, err := mp4.readIlstTags()
+	if err != nil {
+		return nil, err
+	}
+	if tags == nil {
+		tags = &MP4Tags{}
 	}
+	writeChapters := len(tags.Chapters) > 0 || containsStr(delStrings, "chapters")
+	quickTimeTags, err := mp4.getQuickTimeTags(boxes, mergedTags)
+	if err != nil {
+		return nil, err
+	}
+	oldQuickTimeTags := *quickTimeTags
+	quickTimeTags = overwriteTags(quickTimeTags, tags, delStrings)
+	mergedTags = overwriteTags(mergedTags, tags, delStrings)
+	buf := &bytes.Buffer{}
+	err = mp4.writeTags(buf, mergedTags)
+	if err != nil {
+		return nil, err
+	}
+	newIlst := buf.Bytes()
+	quickTimeChanges, err := mp4.planQuickTimeTags(boxes, &oldQuickTimeTags, quickTimeTags)
+	if err != nil {
+		return nil, err
+	}
+
+	if !writeChapters && len(quickTimeChanges) == 0 {
+		patches, err := mp4.planInPlace(boxes, newIlst)
+		if err != nil || patches != nil {
+			return patches, err
+		}
+	}
+	return mp4.planRewrite(boxes, newIlst, mergedTags.Chapters, writeChapters, quickTimeChanges)
+}
 
-	err = resizeBoxes(f, boxes, oldIlstSize, newIlstSize)
+func (mp4 *MP4) actualWriteTo(w io.Writer, tags *MP4Tags, delStrings []string) error {
+	patches, err := mp4.planWrite(tags, delStrings)
 	if err != nil {
 		return err
 	}
+	return mp4.writePatched(w, patches)
+}
 
-	mdat := boxes.getBoxByPath("mdat")
-	if mdat.StartOffset > ilstStartOffset && oldIlstSize != newIlstSize {
-		err = mp4.updateChunkOffsets(f, boxes, oldIlstSize, newIlstSize)
+func (mp4 *MP4) writeInPlace(patches []*patch) error {
+	f, err := os.OpenFile(mp4.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	for _, p := range patches {
+		_, err = f.WriteAt(p.data, p.start)
 		if err != nil {
+			f.Close()
 			return err
 		}
 	}
-
-	_, err = f.Seek(newIlstEndOffset, io.SeekStart)
+	err = f.Sync()
 	if err != nil {
+		f.Close()
 		return err
 	}
-	_, err = mp4.f.Seek(ilst.EndOffset, io.SeekStart)
+	return f.Close()
+}
+
+func (mp4 *MP4) actualWrite(tags *MP4Tags, delStrings []string) error {
+	if mp4.path == "" {
+		return &ErrNoPath{}
+	}
+	patches, err := mp4.planWrite(tags, delStrings)
 	if err != nil {
 		return err
 	}
-	err = mp4.writeRemaining(f)
-	return err
+	return mp4.savePatches(patches)
 }
 
-func (mp4 *MP4) actualWrite(tags *MP4Tags, _delStrings []string) error {
-	delStrings := strArrToLower(_delStrings)
-
-	mergedTags, boxes, err := mp4.actualRead()
+// Applies patches to the file, in place if none change its size, otherwise
+// through a temp file that replaces it.
+func (mp4 *MP4) savePatches(patches []*patch) error {
+	if isInPlace(patches) {
+		return mp4.writeInPlace(patches)
+	}
+	target, err := filepath.EvalSymlinks(mp4.path)
 	if err != nil {
 		return err
 	}
-	if boxes.getBoxByPath("moov.udta.meta.ilst") == nil {
-		return &ErrBoxNotPresent{Msg: "ilst box not present, implement me"}
-	}
-	mergedTags = overwriteTags(mergedTags, tags, delStrings)
-	tempPath := getTempPath(mp4.path)
-	err = mp4.writeTags(boxes, mergedTags, tempPath)
+	f, err := createTemp(target)
 	if err != nil {
 		return err
 	}
-	mp4.Close()
-	err = moveMP4(tempPath, mp4.path)
+	tempPath := f.Name()
+	err = mp4.writePatched(f, patches)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tempPath)
 		return err
 	}
 
+	// Windows won't rename over a file that's still open.
+	mp4.Close()
+	renameErr := os.Rename(tempPath, target)
+	if renameErr != nil {
+		os.Remove(tempPath)
+	} else {
+		syncDir(target)
+	}
+
 	m, err := Open(mp4.path)
-	if err != nil {
+	if renameErr != nil {
+		err = renameErr
+	}
+	if m == nil {
 		return err
 	}
+	mp4.r = m.r
 	mp4.f = m.f
 	mp4.size = m.size
-	return nil
+	mp4.ftyp = m.ftyp
+	return err
 }
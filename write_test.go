@@ -0,0 +1,720 @@
+package mp4tag
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPaddingAfterMeta(t *testing.T) {
+	pad := testBox("free", make([]byte, 16))
+	title := testItem("(c)nam", DataTypeUTF8, []byte("title"))
+	tests := []struct {
+		name string
+		opts testFileOpts
+	}{
+		{"meta", testFileOpts{items: [][]byte{title}, metaExtra: pad}},
+		{"udta", testFileOpts{items: [][]byte{title}, udtaExtra: pad}},
+		{"moov", testFileOpts{items: [][]byte{title}, moovExtra: pad}},
+		{"top level", testFileOpts{items: [][]byte{title}, afterMoov: pad}},
+		{"top level co64", testFileOpts{items: [][]byte{title}, afterMoov: pad, co64: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			mp4.Padding(64)
+			newTitle := strings.Repeat("t", 200)
+			err = mp4.Write(&MP4Tags{Title: newTitle}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != newTitle {
+				t.Errorf("title is %q", tags.Title)
+			}
+		})
+	}
+}
+
+func TestInPlaceWrite(t *testing.T) {
+	pad := testBox("free", make([]byte, 56))
+	title := testItem("(c)nam", DataTypeUTF8, []byte("title"))
+	tests := []struct {
+		name    string
+		opts    testFileOpts
+		title   string
+		inPlace bool
+	}{
+		{"same size", testFileOpts{items: [][]byte{title}}, "eltit", true},
+		{"meta", testFileOpts{items: [][]byte{title}, metaExtra: pad}, "a longer title", true},
+		{"udta", testFileOpts{items: [][]byte{title}, udtaExtra: pad}, "a longer title", true},
+		{"moov", testFileOpts{items: [][]byte{title}, moovExtra: pad}, "a longer title", true},
+		{"top level", testFileOpts{items: [][]byte{title}, afterMoov: pad}, "a longer title", true},
+		{"shrink", testFileOpts{items: [][]byte{title}, udtaExtra: pad}, "t", true},
+		{"pad used up", testFileOpts{items: [][]byte{title}, udtaExtra: pad}, strings.Repeat("t", 61), true},
+		{"no padding", testFileOpts{items: [][]byte{title}}, "a longer title", false},
+		{"pad too small", testFileOpts{items: [][]byte{title}, udtaExtra: pad}, strings.Repeat("t", 62), false},
+		{"pad before ftyp", testFileOpts{items: [][]byte{title}, mdatFirst: true, beforeMoov: pad}, "a longer title", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := makeTestFile(tt.opts)
+			path := writeTestFile(t, data)
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			tags := &MP4Tags{Title: tt.title}
+			patches, err := mp4.planWrite(tags, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isInPlace(patches) != tt.inPlace {
+				t.Fatalf("in place is %v, want %v", isInPlace(patches), tt.inPlace)
+			}
+			err = mp4.Write(tags, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := checkTestFile(t, path)
+			if tt.inPlace && nodes[len(nodes)-1].end != int64(len(data)) {
+				t.Errorf("file size changed from %d to %d", len(data), nodes[len(nodes)-1].end)
+			}
+			read, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Title != tt.title {
+				t.Errorf("title is %q", read.Title)
+			}
+		})
+	}
+}
+
+func TestRewriteReopens(t *testing.T) {
+	path := writeTestFile(t, makeTestFile(testFileOpts{}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	for _, title := range []string{"first", strings.Repeat("t", 100)} {
+		err = mp4.Write(&MP4Tags{Title: title}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTestFile(t, path)
+		if mp4.Ftyp() == nil || mp4.Ftyp().MajorBrand != "M4A " {
+			t.Fatalf("ftyp is %v after write", mp4.Ftyp())
+		}
+		tags, err := mp4.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags.Title != title {
+			t.Errorf("title is %q", tags.Title)
+		}
+	}
+}
+
+func TestOffsetOverflow(t *testing.T) {
+	// A change before a sample near the 4 GiB mark.
+	changes := []*patch{{start: 0, end: 0, data: make([]byte, 32)}}
+	tests := []struct {
+		name     string
+		co64     bool
+		offset   int64
+		overflow bool
+	}{
+		{"stco fits", false, math.MaxUint32 - 32, false},
+		{"stco overflows", false, math.MaxUint32 - 31, true},
+		{"co64", true, math.MaxUint32, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// moov comes last, so its offsets can be swapped without moving
+			// anything.
+			opts := testFileOpts{tracks: 1, co64: tt.co64, mdatFirst: true}
+			data := makeTestFile(opts)
+			moov := makeTestMoov(opts, [][]int64{{tt.offset, tt.offset, tt.offset}})
+			data = append(data[:len(data)-len(moov)], moov...)
+			mp4, err := Open(writeTestFile(t, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			boxes, err := mp4.getBoxes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			box := boxes.getBoxByPath("moov.trak.mdia.minf.stbl.stco")
+			if tt.co64 {
+				box = boxes.getBoxByPath("moov.trak.mdia.minf.stbl.co64")
+			}
+			_, err = mp4.updateChunkOffsetBox(box, changes)
+			var overflowErr *ErrOffsetOverflow
+			if errors.As(err, &overflowErr) != tt.overflow {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestResizeBoxOverflow(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerSize int64
+		newSize    int64
+		tooLarge   bool
+	}{
+		{"fits", 8, math.MaxUint32, false},
+		{"too large", 8, math.MaxUint32 + 1, true},
+		{"largesize", 16, math.MaxUint32 + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			box := &MP4Box{BoxSize: 8, HeaderSize: tt.headerSize, EndOffset: 8, Path: "moov"}
+			_, err := resizeBox(box, tt.newSize)
+			var tooLargeErr *ErrBoxTooLarge
+			if errors.As(err, &tooLargeErr) != tt.tooLarge {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestItunesStik(t *testing.T) {
+	stik := testItem("stik", DataTypeSignedInt, []byte{byte(HomeVideo)})
+	tests := []struct {
+		name       string
+		opts       testFileOpts
+		stik       ItunesStik
+		set        bool
+		delStrings []string
+		want       ItunesStik
+	}{
+		{"none", testFileOpts{}, HomeVideo, false, nil, ItunesStikNone},
+		{"none without udta", testFileOpts{noUdta: true}, HomeVideo, false, nil, ItunesStikNone},
+		{"set", testFileOpts{}, Movie, false, nil, Movie},
+		{"set home video", testFileOpts{}, HomeVideo, true, nil, HomeVideo},
+		{"set home video without udta", testFileOpts{noUdta: true}, HomeVideo, true, nil, HomeVideo},
+		{"keep home video", testFileOpts{items: [][]byte{stik}}, HomeVideo, false, nil, HomeVideo},
+		{"replace", testFileOpts{items: [][]byte{stik}}, Podcast, false, nil, Podcast},
+		{"replace with home video", testFileOpts{items: [][]byte{testItem("stik", DataTypeSignedInt, []byte{byte(Movie)})}}, HomeVideo, true, nil, HomeVideo},
+		{"delete", testFileOpts{items: [][]byte{stik}}, HomeVideo, false, []string{"itunesstik"}, ItunesStikNone},
+		{"delete all", testFileOpts{items: [][]byte{stik}}, HomeVideo, false, []string{"alltags"}, ItunesStikNone},
+		{"delete all and set home video", testFileOpts{items: [][]byte{stik}}, HomeVideo, true, []string{"alltags"}, HomeVideo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.Write(&MP4Tags{Title: "title", ItunesStik: tt.stik, ItunesStikSet: tt.set}, tt.delStrings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.ItunesStik != tt.want {
+				t.Errorf("stik is %d, want %d", tags.ItunesStik, tt.want)
+			}
+			items, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasItem(items, "stik") != (tt.want != ItunesStikNone) {
+				t.Errorf("stik item is wrong in %v", items)
+			}
+		})
+	}
+}
+
+func TestRewriteLayouts(t *testing.T) {
+	title := testItem("(c)nam", DataTypeUTF8, []byte("title"))
+	tests := []struct {
+		name string
+		opts testFileOpts
+	}{
+		{"moov first", testFileOpts{items: [][]byte{title}}},
+		{"moov first co64", testFileOpts{items: [][]byte{title}, co64: true}},
+		{"mdat first", testFileOpts{items: [][]byte{title}, mdatFirst: true}},
+		{"mdat first co64", testFileOpts{items: [][]byte{title}, mdatFirst: true, co64: true}},
+		{"two tracks", testFileOpts{items: [][]byte{title}, tracks: 2}},
+		{"no udta", testFileOpts{noUdta: true}},
+		{"largesize mdat", testFileOpts{items: [][]byte{title}, largeMdat: true}},
+		{"largesize mdat first", testFileOpts{items: [][]byte{title}, largeMdat: true, mdatFirst: true}},
+		{"size 0 mdat", testFileOpts{items: [][]byte{title}, zeroMdat: true}},
+		{"free before ftyp", testFileOpts{items: [][]byte{title}, beforeMoov: testBox("free", make([]byte, 8))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFile(tt.opts))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			newTitle := strings.Repeat("t", 300)
+			err = mp4.Write(&MP4Tags{Title: newTitle}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := checkTestFile(t, path)
+			if !hasTestNode(nodes, "moov.udta.meta.ilst") {
+				t.Error("moov.udta.meta.ilst is missing")
+			}
+			for _, node := range nodes {
+				if node.path != "mdat" {
+					continue
+				}
+				if tt.opts.largeMdat && node.headerSize != 16 {
+					t.Error("mdat lost its largesize header")
+				}
+			}
+			if tt.opts.zeroMdat {
+				written, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Contains(written, append(putI32BE(0), "mdat"...)) {
+					t.Error("mdat lost its size 0 header")
+				}
+			}
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != newTitle {
+				t.Errorf("title is %q", tags.Title)
+			}
+		})
+	}
+}
+
+// Writes tags to a new test file, then writes over them with another title
+// so they have to survive being read back and merged.
+func writeTestTags(t *testing.T, tags *MP4Tags) (*MP4, *MP4Tags) {
+	t.Helper()
+	path := writeTestFile(t, makeTestFile(testFileOpts{}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mp4.Close() })
+	err = mp4.Write(tags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mp4.Write(&MP4Tags{Title: "another title"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	read, err := mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.RawItems) != 0 {
+		t.Errorf("raw items are %v", read.RawItems)
+	}
+	return mp4, read
+}
+
+func TestFlags(t *testing.T) {
+	tags := &MP4Tags{Compilation: true, Gapless: true, HDVideo: true, ShowMovement: true}
+	mp4, read := writeTestTags(t, tags)
+	if !read.Compilation || !read.Gapless || !read.HDVideo || !read.ShowMovement {
+		t.Errorf("flags read as %v %v %v %v", read.Compilation, read.Gapless, read.HDVideo, read.ShowMovement)
+	}
+
+	err := mp4.Write(nil, []string{"compilation", "gapless", "hdvideo", "showmovement"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cpil", "pgap", "hdvd", "shwm"} {
+		if hasItem(items, name) {
+			t.Errorf("%s wasn't deleted", name)
+		}
+	}
+}
+
+func TestClassicalTags(t *testing.T) {
+	tags := &MP4Tags{Work: "Symphony No. 5", MovementName: "Allegro con brio", MovementNumber: 1, MovementCount: 4}
+	mp4, read := writeTestTags(t, tags)
+	if read.Work != tags.Work || read.MovementName != tags.MovementName ||
+		read.MovementNumber != 1 || read.MovementCount != 4 {
+		t.Errorf("read %q %q %d/%d", read.Work, read.MovementName, read.MovementNumber, read.MovementCount)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"(c)mvi", "(c)mvc"} {
+		item := findItem(items, name)
+		if item == nil || item.Type != DataTypeSignedInt {
+			t.Errorf("%s is %v", name, item)
+		}
+	}
+
+	err = mp4.Write(nil, []string{"work", "movementname", "movementnumber", "movementcount"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err = mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Work != "" || read.MovementName != "" || read.MovementNumber > 0 || read.MovementCount > 0 {
+		t.Errorf("read %q %q %d/%d after delete", read.Work, read.MovementName, read.MovementNumber, read.MovementCount)
+	}
+}
+
+func TestPodcastTags(t *testing.T) {
+	tags := &MP4Tags{
+		Category:     "Technology",
+		EpisodeGUID:  "episode-1",
+		Grouping:     "grouping",
+		Keywords:     "go,mp4",
+		Podcast:      true,
+		PodcastURL:   "https://example.com/feed.xml",
+		PurchaseDate: "2020-01-02 03:04:05",
+	}
+	mp4, read := writeTestTags(t, tags)
+	if read.Category != tags.Category || read.EpisodeGUID != tags.EpisodeGUID ||
+		read.Grouping != tags.Grouping || read.Keywords != tags.Keywords || !read.Podcast ||
+		read.PodcastURL != tags.PodcastURL || read.PurchaseDate != tags.PurchaseDate {
+		t.Errorf("read %+v", read)
+	}
+
+	err := mp4.Write(nil, []string{"category", "episodeguid", "grouping", "keywords", "podcast", "podcasturl", "purchasedate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"catg", "egid", "(c)grp", "keyw", "pcst", "purl", "purd"} {
+		if hasItem(items, name) {
+			t.Errorf("%s wasn't deleted", name)
+		}
+	}
+}
+
+func TestSortTags(t *testing.T) {
+	tags := &MP4Tags{
+		AlbumArtistSort: "album artist",
+		AlbumSort:       "album",
+		ArtistSort:      "artist",
+		ComposerSort:    "composer",
+		TitleSort:       "title",
+	}
+	mp4, read := writeTestTags(t, tags)
+	if read.AlbumArtistSort != tags.AlbumArtistSort || read.AlbumSort != tags.AlbumSort ||
+		read.ArtistSort != tags.ArtistSort || read.ComposerSort != tags.ComposerSort ||
+		read.TitleSort != tags.TitleSort {
+		t.Errorf("read %+v", read)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"soaa", "soal", "soar", "soco", "sonm"} {
+		item := findItem(items, name)
+		if item == nil || item.Type != DataTypeUTF8 {
+			t.Errorf("%s is %v", name, item)
+		}
+	}
+
+	for delString, name := range map[string]string{
+		"albumartistsort": "soaa",
+		"albumsort":       "soal",
+		"artistsort":      "soar",
+		"composersort":    "soco",
+		"titlesort":       "sonm",
+	} {
+		err = mp4.Write(nil, []string{delString})
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err = mp4.Items()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasItem(items, name) {
+			t.Errorf("%s wasn't deleted by %s", name, delString)
+		}
+	}
+	read, err = mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.AlbumArtistSort != "" || read.AlbumSort != "" || read.ArtistSort != "" ||
+		read.ComposerSort != "" || read.TitleSort != "" {
+		t.Errorf("read %+v after delete", read)
+	}
+}
+
+func TestVideoTags(t *testing.T) {
+	tags := &MP4Tags{
+		Director:        "director",
+		EncodingTool:    "encoder",
+		LongDescription: "long description",
+		Narrator:        "narrator",
+		TVEpisode:       "S01E02",
+		TVEpisodeNum:    2,
+		TVNetwork:       "network",
+		TVSeason:        1,
+		TVShow:          "show",
+	}
+	mp4, read := writeTestTags(t, tags)
+	if read.Director != tags.Director || read.EncodingTool != tags.EncodingTool ||
+		read.LongDescription != tags.LongDescription || read.Narrator != tags.Narrator ||
+		read.TVEpisode != tags.TVEpisode || read.TVEpisodeNum != 2 || read.TVNetwork != tags.TVNetwork ||
+		read.TVSeason != 1 || read.TVShow != tags.TVShow {
+		t.Errorf("read %+v", read)
+	}
+
+	err := mp4.Write(nil, []string{"director", "encodingtool", "longdescription", "narrator", "tvepisode", "tvepisodenum", "tvnetwork", "tvseason", "tvshow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"(c)dir", "(c)too", "ldes", "(c)nrt", "tven", "tves", "tvnn", "tvsn", "tvsh"} {
+		if hasItem(items, name) {
+			t.Errorf("%s wasn't deleted", name)
+		}
+	}
+	if !hasItem(items, "(c)nam") {
+		t.Errorf("title is missing from %v", items)
+	}
+}
+
+func TestStoreIDs(t *testing.T) {
+	for _, kind := range []ItunesAccountKind{ItunesAccountKindItunes, ItunesAccountKindAOL} {
+		t.Run(fmt.Sprint(kind), func(t *testing.T) {
+			tags := &MP4Tags{
+				ItunesAccount:      "user@example.com",
+				ItunesAccountKind:  kind,
+				ItunesCatalogID:    1440833098,
+				ItunesComposerID:   12345,
+				ItunesGenreID:      21,
+				ItunesOwner:        "Owner",
+				ItunesStorefrontID: 143441,
+			}
+			mp4, read := writeTestTags(t, tags)
+			if read.ItunesAccount != tags.ItunesAccount || read.ItunesAccountKind != kind ||
+				read.ItunesCatalogID != tags.ItunesCatalogID || read.ItunesComposerID != tags.ItunesComposerID ||
+				read.ItunesGenreID != tags.ItunesGenreID || read.ItunesOwner != tags.ItunesOwner ||
+				read.ItunesStorefrontID != tags.ItunesStorefrontID {
+				t.Errorf("read %+v", read)
+			}
+			items, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"cnID", "cmID", "geID", "sfID"} {
+				item := findItem(items, name)
+				if item == nil || item.Type != DataTypeSignedInt || len(item.Data) != 4 {
+					t.Errorf("%s is %v", name, item)
+				}
+			}
+
+			delStrings := []string{
+				"itunesaccount", "itunesaccountkind", "itunescatalogid", "itunescomposerid",
+				"itunesgenreid", "itunesowner", "itunesstorefrontid",
+			}
+			err = mp4.Write(nil, delStrings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, err = mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"apID", "akID", "cnID", "cmID", "geID", "ownr", "sfID"} {
+				if hasItem(items, name) {
+					t.Errorf("%s wasn't deleted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestWideIntAtoms(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int64
+	}{
+		{"64-bit", putI64BE(1<<40 + 7), 1<<40 + 7},
+		{"above 2^31", putI64BE(math.MaxInt32 + 1), math.MaxInt32 + 1},
+		{"32-bit", putI32BE(123456), 123456},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plID := testItem("plID", DataTypeSignedInt, tt.data)
+			path := writeTestFile(t, makeTestFile(testFileOpts{items: [][]byte{plID}}))
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			err = mp4.Write(&MP4Tags{Title: "title"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, path)
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.ItunesAlbumID != tt.want {
+				t.Errorf("album ID is %d, want %d", tags.ItunesAlbumID, tt.want)
+			}
+			items, err := mp4.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			item := findItem(items, "plID")
+			if item == nil || len(item.Data) != 8 || item.Int() != tt.want {
+				t.Errorf("plID is %v", item)
+			}
+		})
+	}
+}
+
+func TestUnsignedStoreIDs(t *testing.T) {
+	cnID := testItem("cnID", DataTypeSignedInt, []byte{0x88, 0xCA, 0x6C, 0x00})
+	path := writeTestFile(t, makeTestFile(testFileOpts{items: [][]byte{cnID}}))
+	mp4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp4.Close()
+	err = mp4.Write(&MP4Tags{ItunesComposerID: math.MaxUint32}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, path)
+	tags, err := mp4.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.ItunesCatalogID != 0x88CA6C00 || tags.ItunesComposerID != math.MaxUint32 {
+		t.Errorf("catalog ID is %d and composer ID is %d", tags.ItunesCatalogID, tags.ItunesComposerID)
+	}
+	items, err := mp4.Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{
+		"cnID": {0x88, 0xCA, 0x6C, 0x00},
+		"cmID": {0xFF, 0xFF, 0xFF, 0xFF},
+	} {
+		item := findItem(items, name)
+		if item == nil || !bytes.Equal(item.Data, want) {
+			t.Errorf("%s is %v, want %v", name, item, want)
+		}
+	}
+}
+
+func TestGenreCodes(t *testing.T) {
+	var codes []Genre
+	for code := Genre(80); code <= 192; code++ {
+		if code.String() == "" {
+			t.Errorf("gnre code %d isn't in the table", code)
+		}
+		codes = append(codes, code)
+	}
+	// Unknown codes are kept as they are.
+	codes = append(codes, 193, 255, 1000)
+	for _, code := range codes {
+		gnre := testItem("gnre", DataTypeBinary, putI16BE(int16(code)))
+		path := writeTestFile(t, makeTestFile(testFileOpts{items: [][]byte{gnre}}))
+		mp4, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mp4.Write(&MP4Tags{Title: "title"}, nil)
+		if err != nil {
+			mp4.Close()
+			t.Fatal(err)
+		}
+		tags, err := mp4.Read()
+		mp4.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags.Genre != code {
+			t.Errorf("gnre code %d read back as %d", code, tags.Genre)
+		}
+	}
+
+	_, read := writeTestTags(t, &MP4Tags{Genre: GenrePsybient})
+	if read.Genre != GenrePsybient {
+		t.Errorf("genre is %d", read.Genre)
+	}
+}
+
+func TestFragmentedWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		padding int64
+	}{
+		{"grow", strings.Repeat("t", 300), 0},
+		{"grow with padding", strings.Repeat("t", 300), 256},
+		{"in place", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, makeTestFragFile())
+			mp4, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp4.Close()
+			mp4.Padding(tt.padding)
+			err = mp4.Write(&MP4Tags{Title: tt.title}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFragFile(t, path)
+			tags, err := mp4.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags.Title != tt.title {
+				t.Errorf("title is %q", tags.Title)
+			}
+		})
+	}
+}